@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// accountInfo 当前凭据对应的账号状态
+type accountInfo struct {
+	LoggedIn   bool   `json:"logged_in"`
+	Uid        int    `json:"uid,omitempty"`
+	Uname      string `json:"uname,omitempty"`
+	Face       string `json:"face,omitempty"`
+	Level      int    `json:"level,omitempty"`
+	Vip        bool   `json:"vip"`
+	VipType    int    `json:"vip_type,omitempty"`     // 1: 月度大会员, 2: 年度及以上大会员
+	VipDueDate int64  `json:"vip_due_date,omitempty"` // unix 时间戳(ms)
+	CheckedAt  int64  `json:"checked_at"`             // unix 时间戳(s)
+}
+
+var (
+	// 账号名 -> 状态, 默认账号为 ""
+	accounts  = map[string]accountInfo{}
+	accountMu sync.RWMutex
+)
+
+// getAccount 返回最近一次获取的账号状态, 具名账号首次使用时获取
+func getAccount(name string) accountInfo {
+	accountMu.RLock()
+	info, ok := accounts[name]
+	accountMu.RUnlock()
+	if ok || name == "" {
+		return info
+	}
+
+	nav, err := fetchNavAs(name)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("account", name).
+			Msg("Failed to fetch account info")
+		return info
+	}
+	info = accountFromNav(nav)
+	accountMu.Lock()
+	accounts[name] = info
+	accountMu.Unlock()
+	return info
+}
+
+// accountFromNav 从 nav 中取出账号状态
+func accountFromNav(nav biligo.Nav) accountInfo {
+	info := accountInfo{
+		LoggedIn:  nav.IsLogin,
+		CheckedAt: time.Now().Unix(),
+	}
+	if nav.IsLogin {
+		info.Uid = nav.Mid
+		info.Uname = nav.Uname
+		info.Face = nav.Face
+		info.Level = nav.LevelInfo.CurrentLevel
+		info.Vip = nav.VipStatus == 1 && nav.VipType > 0
+		info.VipType = nav.VipType
+		info.VipDueDate = nav.VipDueDate
+	}
+	return info
+}
+
+// refreshAccount 重新获取默认账号的状态, 登录/刷新 cookie 后调用
+func refreshAccount() {
+	nav, err := biligo.FetchNav()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to fetch account info")
+		return
+	}
+
+	info := accountFromNav(nav)
+	accountMu.Lock()
+	accounts[""] = info
+	accountMu.Unlock()
+
+	switch {
+	case !info.LoggedIn:
+		log.Warn().
+			Msg("Not logged in, quality is limited to 480P~1080P")
+	case !info.Vip:
+		log.Info().
+			Int("uid", info.Uid).
+			Str("uname", info.Uname).
+			Msg("Logged in without VIP, quality is limited to 1080P")
+	default:
+		log.Info().
+			Int("uid", info.Uid).
+			Str("uname", info.Uname).
+			Time("vipDueDate", time.UnixMilli(info.VipDueDate)).
+			Msg("Logged in with VIP")
+	}
+}
+
+// qualityLimitReason 视频有不高于 maxQuality 的更高画质却拿不到时, 返回受限的原因:
+// "login" 需要登录, "vip" 需要大会员, 不受限时为空
+func qualityLimitReason(acceptQuality []int, dash *biligo.DideoPlayurlDash, account string) string {
+	wanted := 0
+	for _, q := range acceptQuality {
+		if q <= maxQuality && q > wanted {
+			wanted = q
+		}
+	}
+	available := 0
+	for _, v := range dash.Video {
+		if v.Id <= maxQuality && v.Id > available {
+			available = v.Id
+		}
+	}
+	if wanted <= available {
+		return ""
+	}
+
+	acc := getAccount(account)
+	switch {
+	case !acc.LoggedIn:
+		return "login"
+	case !acc.Vip:
+		return "vip"
+	default:
+		return "unavailable"
+	}
+}
+
+// apiAccount 账号状态, account 指定具名账号
+func apiAccount(w http.ResponseWriter, r *http.Request) {
+	account, err := requestAccount(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	if r.URL.Query().Get("refresh") == "1" {
+		if account == "" {
+			refreshAccount()
+		} else {
+			forgetNamedIdentity(account)
+		}
+	}
+	writeJSON(w, getAccount(account))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	netUrl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// biligo 的凭据是全局的, 只用于默认账号 (-account),
+// 其他账号的请求带上各自的 cookie 单独发出
+
+var (
+	// 账号名 -> 凭据, 按需从 IDENTITY_DIR 读取
+	namedIdentities   = map[string]biligo.Identity{}
+	namedIdentitiesMu sync.Mutex
+)
+
+// namedIdentity 读取具名账号的凭据, 优先从缓存获取
+func namedIdentity(account string) (biligo.Identity, error) {
+	namedIdentitiesMu.Lock()
+	defer namedIdentitiesMu.Unlock()
+	if id, ok := namedIdentities[account]; ok {
+		return id, nil
+	}
+	id, _, err := readIdentity(account)
+	if err != nil {
+		// 错误中含有文件路径, 只记录在日志中
+		log.Warn().
+			Err(err).
+			Str("account", account).
+			Msg("Failed to read account identity")
+		return id, fmt.Errorf("unknown account %q", account)
+	}
+	namedIdentities[account] = id
+	return id, nil
+}
+
+// forgetNamedIdentity 凭据文件更新后丢弃缓存
+func forgetNamedIdentity(account string) {
+	namedIdentitiesMu.Lock()
+	delete(namedIdentities, account)
+	namedIdentitiesMu.Unlock()
+
+	accountMu.Lock()
+	delete(accounts, account)
+	accountMu.Unlock()
+}
+
+type accountRule struct {
+	match   string // 客户端 IP, 或 User-Agent 中的子串
+	account string
+}
+
+var accountRules []accountRule
+
+// parseAccountRules 解析 -account-rules, "192.168.1.20=vip,Kodi=vip"
+func parseAccountRules(s string) {
+	for part := range strings.SplitSeq(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match, account, ok := strings.Cut(part, "=")
+		if !ok || match == "" || !validAccountName(account) {
+			log.Warn().
+				Str("rule", part).
+				Msg("Invalid account rule")
+			continue
+		}
+		accountRules = append(accountRules, accountRule{match, account})
+	}
+}
+
+// requestAccount 请求所用的账号, query account 优先, 其次为 -account-rules,
+// 返回空时使用默认账号
+func requestAccount(r *http.Request) (string, error) {
+	account := r.URL.Query().Get("account")
+	if account == "" {
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		ua := r.Header.Get("User-Agent")
+		for _, rule := range accountRules {
+			if rule.match == ip || strings.Contains(ua, rule.match) {
+				account = rule.account
+				break
+			}
+		}
+	}
+	if account == "" || account == *fAccount {
+		return "", nil
+	}
+	if !validAccountName(account) {
+		return "", fmt.Errorf("invalid account %q", account)
+	}
+	if _, err := namedIdentity(account); err != nil {
+		return "", err
+	}
+	return account, nil
+}
+
+// 具名账号的请求不经过 biligo: 其全局 cookie jar 会把默认账号的 cookie 附加到请求上
+const ACCOUNT_REQUEST_TIMEOUT = 15 * time.Second
+
+var accountClient = &http.Client{Timeout: ACCOUNT_REQUEST_TIMEOUT}
+
+// identityGet 带上账号的 cookie 请求接口, 将 data 解析到 v,
+// okCodes 中的非 0 code 同样视为成功 (如 nav 未登录时的 -101)
+func identityGet(id biligo.Identity, url string, query netUrl.Values, wbi bool, v any, okCodes ...int) error {
+	req, err := http.NewRequest(http.MethodGet, url+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if wbi {
+		err = biligo.WbiSign(req.URL)
+		if err != nil {
+			return err
+		}
+	}
+	for k, v := range biligo.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Cookie", id.Cookie)
+
+	resp, err := accountClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &biliStatusError{StatusCode: resp.StatusCode}
+	}
+
+	var body struct {
+		Code    int             `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return err
+	}
+	if body.Code != 0 {
+		ok := false
+		for _, code := range okCodes {
+			ok = ok || code == body.Code
+		}
+		if !ok {
+			codeErr := &biliCodeError{Code: body.Code, Message: body.Message}
+			json.Unmarshal(body.Data, &codeErr.Data)
+			return codeErr
+		}
+	}
+	backoff.succeed()
+	return json.Unmarshal(body.Data, v)
+}
+
+// fetchPlayurlAs 以具名账号获取播放地址
+func fetchPlayurlAs(account string, aid, cid int) (biligo.VideoPlayurl, error) {
+	var playurl biligo.VideoPlayurl
+	id, err := namedIdentity(account)
+	if err != nil {
+		return playurl, err
+	}
+	err = identityGet(id, biligo.URL_VIDEO_PALYURL_WBI, netUrl.Values{
+		"avid":  {strconv.Itoa(aid)},
+		"cid":   {strconv.Itoa(cid)},
+		"fnval": {strconv.Itoa(int(biligo.VIDED_FNVAL_DASHALL))},
+		"fourk": {"1"},
+	}, true, &playurl)
+	return playurl, err
+}
+
+// fetchNavAs 以具名账号获取 nav
+func fetchNavAs(account string) (biligo.Nav, error) {
+	var nav biligo.Nav
+	id, err := namedIdentity(account)
+	if err != nil {
+		return nav, err
+	}
+	err = identityGet(id, biligo.URL_NAV, netUrl.Values{}, false, &nav, -101)
+	return nav, err
+}
+
+// accountSuffix 缓存键中区分账号, 默认账号为空
+func accountSuffix(account string) string {
+	if account == "" {
+		return ""
+	}
+	return "@" + account
+}
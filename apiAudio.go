@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 音频区歌曲流地址
+//
+//	.WithQuerys("sid", auid, "privilege", "2", "quality", "2")
+const URL_SONG_STREAM = `https://www.bilibili.com/audio/music-service-c/web/url`
+
+const AUDIO_CACHE_TTL = time.Hour
+
+var (
+	audioCacheDir = filepath.Join(os.TempDir(), "BiliProxyM3U8-audio")
+	// 同一个文件同时只封装一次, 封装结束后删除
+	audioRemuxMu sync.Map // key -> *sync.Mutex
+)
+
+// audioTrack 封装 m4a 所需的信息
+type audioTrack struct {
+	key      string // 缓存文件名
+	url      string // 已有缓存时为空
+	title    string
+	artist   string
+	album    string
+	comment  string
+	cover    string
+	date     int
+	chapters []ChapterData
+	start    int // 从此处开始封装(s)
+}
+
+// fetchSongStream 获取音频区歌曲的流地址
+func fetchSongStream(auid string) (string, error) {
+	req := biligo.Chain{Req: biligo.NewGet(URL_SONG_STREAM).
+		WithQuerys("sid", auid, "privilege", "2", "quality", "2")}
+	err := doChain(&req)
+	if err != nil {
+		return "", err
+	}
+	var cdns []string
+	err = req.ParseTo(&cdns, "data", "cdns")
+	if err != nil {
+		return "", err
+	}
+	if len(cdns) == 0 {
+		return "", fmt.Errorf("no song stream available")
+	}
+	return cdns[0], nil
+}
+
+// audioPath 缓存文件路径, 不在缓存目录下时返回 false
+func audioPath(key, ext string) (string, bool) {
+	path := filepath.Join(audioCacheDir, key+ext)
+	return path, filepath.Dir(path) == filepath.Clean(audioCacheDir)
+}
+
+// cachedAudio 未过期的 m4a 缓存
+func cachedAudio(key string) (string, bool) {
+	path, ok := audioPath(key, ".m4a")
+	if !ok {
+		return "", false
+	}
+	stat, err := os.Stat(path)
+	return path, err == nil && time.Since(stat.ModTime()) < AUDIO_CACHE_TTL
+}
+
+// audioKey 缓存文件名, 从 start(s) 处开始时单独缓存
+func audioKey(key string, start int) string {
+	if start > 0 {
+		key += "_t" + strconv.Itoa(start)
+	}
+	return key
+}
+
+// resolveAudioTrack 解析 av/BV 号的分P或 au 号的歌曲,
+// 已有缓存时不再请求流地址
+func resolveAudioTrack(id, p, account string, start int) (*audioTrack, error) {
+	if auid, ok := strings.CutPrefix(id, "au"); ok {
+		// id 会成为缓存文件名, 先确认是数字
+		if _, err := strconv.ParseUint(auid, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid au id: %q", id)
+		}
+		if _, ok := cachedAudio(audioKey(id, start)); ok {
+			return &audioTrack{key: audioKey(id, start), start: start}, nil
+		}
+		// 只需要歌曲信息, 不必像 biligo.FetchSong 一并请求标签/成员/歌词
+		info, _, _, _ := biligo.ReqAudio(auid)
+		req := biligo.Chain{Req: info}
+		err := doChain(&req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch song: %w", err)
+		}
+		song, err := req.ToSongInfo()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch song: %w", err)
+		}
+		url, err := fetchSongStream(auid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch song stream: %w", err)
+		}
+		artist := song.Author
+		if artist == "" {
+			artist = song.Uname
+		}
+		track := &audioTrack{
+			key:     id,
+			url:     url,
+			title:   song.Title,
+			artist:  artist,
+			comment: song.Intro,
+			cover:   song.Cover,
+			date:    song.Passtime,
+		}
+		track.seek(start)
+		return track, nil
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch video info: %w", err)
+	}
+	pageNum, err := resolvePageNum(p, vInfo)
+	if err != nil {
+		return nil, err
+	}
+	page := vInfo.Pages[pageNum-1]
+	key := fmt.Sprintf("%d_%d%s", vInfo.Aid, page.Cid, accountSuffix(account))
+	if _, ok := cachedAudio(audioKey(key, start)); ok {
+		return &audioTrack{key: audioKey(key, start), start: start}, nil
+	}
+
+	playurl, err := fetchPlayurl(vInfo.Aid, page.Cid, account)
+	if err != nil {
+		return nil, err
+	}
+	_, audio := selectDashStreams(playurl.Dash)
+
+	chapters, err := fetchChapters(vInfo.Aid, page.Cid)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to fetch chapters")
+	}
+
+	track := &audioTrack{
+		key:      key,
+		url:      audio.BackupUrl[0],
+		title:    pageTitle(vInfo, pageNum),
+		artist:   vInfo.Owner.Name,
+		album:    vInfo.Title,
+		comment:  vInfo.Desc,
+		cover:    vInfo.Pic,
+		date:     vInfo.PubDate,
+		chapters: chapters,
+	}
+	track.seek(start)
+	return track, nil
+}
+
+// apiAudio 返回附带标题/作者/封面/章节的 m4a,
+// 没有 ffmpeg 时直接转发音频流
+func apiAudio(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := r.URL.Query().Get("p")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty id")
+		return
+	}
+	log.Info().
+		Str("id", id).
+		Str("p", p).
+		Str("range", r.Header.Get("Range")).
+		Msg("Audio request")
+
+	account, err := requestAccount(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	if !checkBackoff(w) {
+		return
+	}
+
+	track, err := resolveAudioTrack(id, p, account, startTime(r))
+	if isBiliError(err) {
+		writeAPIError(w, err, "Failed to resolve audio track")
+		return
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to resolve audio track")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	// 解析时已命中缓存则没有流地址
+	path, _ := cachedAudio(track.key)
+	if track.url != "" {
+		ffmpeg, err := exec.LookPath(*fFFmpeg)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Msg("ffmpeg not found, serving audio stream without tags or seeking")
+			proxyUpstream(w, r, track.url)
+			return
+		}
+		path, err = remuxAudio(ffmpeg, track)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to remux audio")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Failed to remux audio: %v", err)
+			return
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.m4a\"", track.key))
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+// seek 从 start 秒处开始封装, 章节随之平移
+func (track *audioTrack) seek(start int) {
+	if start <= 0 {
+		return
+	}
+	track.start = start
+	track.key = audioKey(track.key, start)
+	chapters := make([]ChapterData, 0, len(track.chapters))
+	for _, c := range track.chapters {
+		if c.End <= start {
+			continue
+		}
+		chapters = append(chapters, ChapterData{
+			Start: max(c.Start-start, 0),
+			End:   c.End - start,
+			Title: c.Title,
+		})
+	}
+	track.chapters = chapters
+}
+
+// remuxAudio 用 ffmpeg 封装为 m4a 并缓存, 返回文件路径,
+// 封装在服务的生命周期内进行, 客户端断开不会中止, 之后的请求可直接使用缓存
+func remuxAudio(ffmpeg string, track *audioTrack) (string, error) {
+	mu, _ := audioRemuxMu.LoadOrStore(track.key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	// 等待中的请求持有旧的锁, 解锁后会直接命中缓存
+	defer audioRemuxMu.CompareAndDelete(track.key, mu)
+
+	if path, ok := cachedAudio(track.key); ok {
+		return path, nil
+	}
+	path, ok := audioPath(track.key, ".m4a")
+	if !ok {
+		return "", fmt.Errorf("invalid audio key: %q", track.key)
+	}
+	err := os.MkdirAll(audioCacheDir, 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	var headers strings.Builder
+	for _, k := range []string{"Referer", "User-Agent"} {
+		headers.WriteString(k + ": " + biligo.DefaultHeaders[k] + "\r\n")
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	if track.start > 0 {
+		args = append(args, "-ss", strconv.Itoa(track.start))
+	}
+	args = append(args, "-headers", headers.String(), "-i", track.url)
+	maps := []string{"-map", "0:a"}
+	inputs := 1
+	if track.cover != "" {
+		args = append(args, "-i", biliImageUrl(track.cover, 0, 0, ""))
+		maps = append(maps, "-map", strconv.Itoa(inputs)+":v", "-c:v", "mjpeg", "-disposition:v:0", "attached_pic")
+		inputs++
+	}
+	if len(track.chapters) > 0 {
+		var meta bytes.Buffer
+		err = FFMetadataTemplate.Execute(&meta, FFMetadata{Chapters: track.chapters})
+		if err != nil {
+			return "", err
+		}
+		metaPath, _ := audioPath(track.key, ".ffmetadata")
+		err = os.WriteFile(metaPath, meta.Bytes(), 0o644)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(metaPath)
+		args = append(args, "-i", metaPath)
+		maps = append(maps, "-map_chapters", strconv.Itoa(inputs))
+		inputs++
+	}
+	args = append(args, maps...)
+	args = append(args, "-c:a", "copy")
+	for k, v := range map[string]string{
+		"title":   track.title,
+		"artist":  track.artist,
+		"album":   track.album,
+		"comment": track.comment,
+	} {
+		if v != "" {
+			args = append(args, "-metadata", k+"="+v)
+		}
+	}
+	if track.date != 0 {
+		args = append(args, "-metadata", "date="+time.Unix(int64(track.date), 0).Format(time.DateOnly))
+	}
+	tmp, err := os.CreateTemp(audioCacheDir, track.key+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	tmpPath := tmp.Name()
+	args = append(args, "-f", "ipod", "-movflags", "+faststart", tmpPath)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(cwg.Ctx, ffmpeg, args...)
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return path, os.Rename(tmpPath, path)
+}
+
+// cleanupAudioCache 删除超过 ttl 的 m4a, ttl 为 0 时删除全部 (正在封装的除外)
+func cleanupAudioCache(ttl time.Duration) {
+	entries, err := os.ReadDir(audioCacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if ttl == 0 && strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ttl {
+			continue
+		}
+		os.Remove(filepath.Join(audioCacheDir, entry.Name()))
+	}
+}
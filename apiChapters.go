@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 播放器信息, 包含 UP 主设置的章节 (view_points)
+//
+//	.WithQuerys("aid", aid, "cid", cid)
+const URL_PLAYER_V2_WBI = `https://api.bilibili.com/x/player/wbi/v2`
+
+type viewPoint struct {
+	Type    int    `json:"type"` // 2: 章节
+	From    int    `json:"from"` // (s)
+	To      int    `json:"to"`   // (s)
+	Content string `json:"content"`
+	ImgUrl  string `json:"imgUrl"`
+}
+
+// fetchChapters 获取分P的章节, 优先从缓存获取
+func fetchChapters(aid, cid int) ([]ChapterData, error) {
+	key := fmt.Sprintf("%d/%d", aid, cid)
+	if chapters, ok := getCached[[]ChapterData](viewPointCache, key); ok {
+		return chapters, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_PLAYER_V2_WBI).WbiSign().
+		WithQuerys("aid", strconv.Itoa(aid), "cid", strconv.Itoa(cid))}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var viewPoints []viewPoint
+	err = req.ParseTo(&viewPoints, "data", "view_points")
+	if err != nil {
+		// 没有章节时不存在该字段
+		if biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+			err = nil
+		} else {
+			return nil, err
+		}
+	}
+
+	chapters := make([]ChapterData, 0, len(viewPoints))
+	for _, vp := range viewPoints {
+		// 其他类型为高能进度条等标记, 不是章节
+		if vp.Type != 2 || vp.To <= vp.From {
+			continue
+		}
+		chapters = append(chapters, ChapterData{
+			Start: vp.From,
+			End:   vp.To,
+			Title: vp.Content,
+		})
+	}
+
+	setCached(viewPointCache, key, chapters, 30*time.Minute)
+	return chapters, nil
+}
+
+// attachChapters 为播放列表中的各P附带章节, 最多 MPD_MAX_PAGES 个分P
+func attachChapters(vInfo *biligo.VideoInfo, items []M3u8Item) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MPD_FETCH_CONCURRENCY)
+	for i := range items[:min(len(items), MPD_MAX_PAGES)] {
+		if items[i].Page < 1 || items[i].Page > len(vInfo.Pages) {
+			continue
+		}
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			chapters, err := fetchChapters(vInfo.Aid, vInfo.Pages[items[i].Page-1].Cid)
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Int("page", items[i].Page).
+					Msg("Failed to fetch chapters")
+				return
+			}
+			items[i].Chapters = chapters
+		})
+	}
+	wg.Wait()
+}
+
+// hlsChapter Apple HLS 章节 json 格式 (com.apple.hls.chapters)
+type hlsChapter struct {
+	Chapter   int               `json:"chapter"`
+	StartTime int               `json:"start-time"`
+	Duration  int               `json:"duration"`
+	Titles    []hlsChapterTitle `json:"titles"`
+}
+
+type hlsChapterTitle struct {
+	Language string `json:"language"`
+	Title    string `json:"title"`
+}
+
+// apiChapters 返回指定分P的章节,
+// format: vtt (默认), ffmetadata, json
+func apiChapters(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty id")
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	log.Info().
+		Str("id", id).
+		Str("p", query.Get("p")).
+		Str("format", format).
+		Msg("Chapters request")
+
+	if !checkBackoff(w) {
+		return
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
+	}
+
+	pageNum, err := resolvePageNum(query.Get("p"), vInfo)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	page := vInfo.Pages[pageNum-1]
+
+	chapters, err := fetchChapters(vInfo.Aid, page.Cid)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch chapters")
+		return
+	}
+
+	switch format {
+	case "", "vtt", "webvtt":
+		cues := make([]VttCue, len(chapters))
+		for i, c := range chapters {
+			cues[i] = VttCue{Start: c.Start * 1000, End: c.End * 1000, Text: c.Title}
+		}
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		err = VttTemplate.Execute(w, VttData{Cues: cues})
+
+	case "ffmetadata":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = FFMetadataTemplate.Execute(w, FFMetadata{
+			Title:    pageTitle(vInfo, pageNum),
+			Artist:   vInfo.Owner.Name,
+			Comment:  vInfo.Desc,
+			Chapters: chapters,
+		})
+
+	case "json":
+		hlsChapters := make([]hlsChapter, len(chapters))
+		for i, c := range chapters {
+			hlsChapters[i] = hlsChapter{
+				Chapter:   i + 1,
+				StartTime: c.Start,
+				Duration:  c.End - c.Start,
+				Titles:    []hlsChapterTitle{{Language: "und", Title: c.Title}},
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(hlsChapters)
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown format: %s", format)
+		return
+	}
+
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("format", format).
+			Msg("Failed to write chapters")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 合集 (ugc_season) 内的视频
+	//	.WithQuerys("mid", mid, "season_id", seasonId, "page_num", pn, "page_size", "100")
+	URL_SEASON_ARCHIVES = `https://api.bilibili.com/x/polymer/web-space/seasons_archives_list`
+	// 列表 (series) 内的视频
+	//	.WithQuerys("mid", mid, "series_id", seriesId, "pn", pn, "ps", "100", "sort", "asc")
+	URL_SERIES_ARCHIVES = `https://api.bilibili.com/x/series/archives`
+	// 列表信息
+	//	.WithQuery("series_id", seriesId)
+	URL_SERIES_INFO = `https://api.bilibili.com/x/series/series`
+)
+
+const (
+	// 最多翻页数, 每页 100 个视频
+	COLLECTION_MAX_PAGES = 10
+	// expand=1 时最多展开的视频数, 展开需逐个获取视频信息
+	COLLECTION_MAX_EXPAND = 50
+)
+
+type archive struct {
+	Aid      int    `json:"aid"`
+	Bvid     string `json:"bvid"`
+	Title    string `json:"title"`
+	Pic      string `json:"pic"`
+	Duration int    `json:"duration"`
+	PubDate  int    `json:"pubdate"`
+}
+
+type archiveList struct {
+	Title    string
+	Cover    string
+	Desc     string
+	Archives []archive
+}
+
+// fetchSeason 翻页获取合集内的视频, 最多 COLLECTION_MAX_PAGES 页, 优先从缓存获取
+func fetchSeason(mid, seasonId string) (*archiveList, error) {
+	key := "season/" + seasonId
+	if list, ok := getCached[*archiveList](playlistCache, key); ok {
+		return list, nil
+	}
+
+	list := &archiveList{}
+	for pn := 1; pn <= COLLECTION_MAX_PAGES; pn++ {
+		req := biligo.Chain{Req: biligo.NewGet(URL_SEASON_ARCHIVES).
+			WithQuerys("mid", mid, "season_id", seasonId, "page_num", strconv.Itoa(pn), "page_size", "100")}
+		err := doChain(&req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Archives []archive `json:"archives"`
+			Meta     struct {
+				Name        string `json:"name"`
+				Cover       string `json:"cover"`
+				Description string `json:"description"`
+				Total       int    `json:"total"`
+			} `json:"meta"`
+		}
+		err = req.ParseTo(&page, "data")
+		if err != nil {
+			return nil, err
+		}
+
+		list.Title, list.Cover, list.Desc = page.Meta.Name, page.Meta.Cover, page.Meta.Description
+		list.Archives = append(list.Archives, page.Archives...)
+		if len(page.Archives) == 0 || len(list.Archives) >= page.Meta.Total {
+			break
+		}
+	}
+
+	setCached(playlistCache, key, list, 5*time.Minute)
+	return list, nil
+}
+
+// fetchSeries 翻页获取列表内的视频, 最多 COLLECTION_MAX_PAGES 页, 优先从缓存获取
+func fetchSeries(mid, seriesId string) (*archiveList, error) {
+	key := "series/" + seriesId
+	if list, ok := getCached[*archiveList](playlistCache, key); ok {
+		return list, nil
+	}
+
+	list := &archiveList{}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_SERIES_INFO).
+		WithQuery("series_id", seriesId)}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var meta struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	err = req.ParseTo(&meta, "data", "meta")
+	if err != nil {
+		return nil, err
+	}
+	list.Title, list.Desc = meta.Name, meta.Description
+
+	for pn := 1; pn <= COLLECTION_MAX_PAGES; pn++ {
+		req := biligo.Chain{Req: biligo.NewGet(URL_SERIES_ARCHIVES).
+			WithQuerys("mid", mid, "series_id", seriesId, "pn", strconv.Itoa(pn), "ps", "100", "sort", "asc")}
+		err := doChain(&req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Archives []archive `json:"archives"`
+			Page     struct {
+				Total int `json:"total"`
+			} `json:"page"`
+		}
+		err = req.ParseTo(&page, "data")
+		if err != nil {
+			return nil, err
+		}
+
+		list.Archives = append(list.Archives, page.Archives...)
+		if len(page.Archives) == 0 || len(list.Archives) >= page.Page.Total {
+			break
+		}
+	}
+	if len(list.Archives) > 0 {
+		list.Cover = list.Archives[0].Pic
+	}
+
+	setCached(playlistCache, key, list, 5*time.Minute)
+	return list, nil
+}
+
+// fetchVideoSeason 获取视频所属合集的 id, 不属于合集时返回 0
+func fetchVideoSeason(aid int) (seasonId int, err error) {
+	key := "season-of/" + strconv.Itoa(aid)
+	if seasonId, ok := getCached[int](playlistCache, key); ok {
+		return seasonId, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(biligo.URL_VIDEO_INFO).
+		WithQuery("aid", strconv.Itoa(aid))}
+	err = doChain(&req)
+	if err != nil {
+		return 0, err
+	}
+	err = req.ParseTo(&seasonId, "data", "ugc_season", "id")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return 0, err
+	}
+
+	setCached(playlistCache, key, seasonId, 30*time.Minute)
+	return seasonId, nil
+}
+
+func apiCollection(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	mid, seasonId := r.PathValue("mid"), r.PathValue("seasonId")
+	log.Info().
+		Str("mid", mid).
+		Str("seasonId", seasonId).
+		Msg("Collection request")
+
+	list, err := fetchSeason(mid, seasonId)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch collection")
+		return
+	}
+	writeArchiveList(w, r, "collection_"+seasonId, list)
+}
+
+func apiSeries(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	mid, seriesId := r.PathValue("mid"), r.PathValue("seriesId")
+	log.Info().
+		Str("mid", mid).
+		Str("seriesId", seriesId).
+		Msg("Series request")
+
+	list, err := fetchSeries(mid, seriesId)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch series")
+		return
+	}
+	writeArchiveList(w, r, "series_"+seriesId, list)
+}
+
+// writeArchiveList 输出合集/列表播放列表, 支持 expand=1 与 format=json
+func writeArchiveList(w http.ResponseWriter, r *http.Request, filename string, list *archiveList) {
+	expand := r.URL.Query().Get("expand") == "1"
+	baseUrl := requestBaseUrl(r)
+
+	// 合集接口不返回分P数, 展开时需获取视频信息, 超出 COLLECTION_MAX_EXPAND 的不展开
+	archiveItems := make([][]M3u8Item, len(list.Archives))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MPD_FETCH_CONCURRENCY)
+	for i, a := range list.Archives {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			archiveItems[i] = listVideoItems(baseUrl, a.Bvid, 0, expand && i < COLLECTION_MAX_EXPAND, M3u8Item{
+				Duration: a.Duration,
+				Title:    a.Title,
+				Cover:    imageProxyUrl(baseUrl, a.Pic, 0, 0),
+				Group:    list.Title,
+				Bvid:     a.Bvid,
+				PubDate:  a.PubDate,
+			})
+		})
+	}
+	wg.Wait()
+	items := slices.Concat(archiveItems...)
+
+	data := M3u8Data{
+		Title: list.Title,
+		Cover: imageProxyUrl(baseUrl, list.Cover, 0, 0),
+		Items: items,
+	}
+	if wantJSON(r) {
+		writeJSON(w, data)
+		return
+	}
+	writeM3U8(w, filename, data)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 接口错误的分类, 用于 json 错误中的 error
+const (
+	ERR_RATE_LIMITED   = "rate_limited"   // 请求过于频繁
+	ERR_RISK_CONTROL   = "risk_control"   // 风控 / 需要验证
+	ERR_REGION_BLOCKED = "region_blocked" // 地区限制
+	ERR_VIP_ONLY       = "vip_only"       // 大会员 / 充电专属
+	ERR_DELETED        = "deleted"        // 稿件已删除 / 不可见
+	ERR_NOT_FOUND      = "not_found"
+	ERR_UPSTREAM       = "upstream_error"
+)
+
+const (
+	BACKOFF_MIN = 30 * time.Second
+	BACKOFF_MAX = 10 * time.Minute
+)
+
+// biliCodeError 接口返回的非 0 code
+type biliCodeError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		VVoucher string `json:"v_voucher"` // 需要人机验证
+	} `json:"data"`
+}
+
+func (e *biliCodeError) Error() string {
+	return fmt.Sprintf("code %d: %s", e.Code, e.Message)
+}
+
+// biliStatusError 接口返回的非 200 状态,
+// 风控时常为 412 与 html 页面, 此时 biligo 会将其视为 code 0
+type biliStatusError struct {
+	StatusCode int
+}
+
+func (e *biliStatusError) Error() string {
+	return fmt.Sprintf("status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// doChain 代替 Chain.Do, 将非 200 状态与非 0 code 转为可分类的错误,
+// 成功时结束退避
+func doChain(c *biligo.Chain) error {
+	err := c.Do()
+	if c.Resp != nil && c.Resp.StatusCode != http.StatusOK {
+		return &biliStatusError{StatusCode: c.Resp.StatusCode}
+	}
+	if err != nil {
+		if biligo.UnwrapErr(err).Is(biligo.ErrChainRespCodeNotZero) {
+			codeErr := &biliCodeError{}
+			if json.Unmarshal([]byte(c.Body), codeErr) == nil {
+				return codeErr
+			}
+		}
+		return err
+	}
+	backoff.succeed()
+	return nil
+}
+
+// biliCode 取出错误中的 code
+func biliCode(err error) (*biliCodeError, bool) {
+	var codeErr *biliCodeError
+	if errors.As(err, &codeErr) {
+		return codeErr, true
+	}
+	return nil, false
+}
+
+// isBiliError 错误来自B站接口 (非 0 code 或非 200 状态)
+func isBiliError(err error) bool {
+	var statusErr *biliStatusError
+	_, ok := biliCode(err)
+	return ok || errors.As(err, &statusErr)
+}
+
+// classifyError 错误的分类与对应的 HTTP 状态码
+func classifyError(err error) (kind string, status int) {
+	var statusErr *biliStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusPreconditionFailed:
+			return ERR_RISK_CONTROL, http.StatusTooManyRequests
+		case http.StatusTooManyRequests:
+			return ERR_RATE_LIMITED, http.StatusTooManyRequests
+		case http.StatusNotFound:
+			return ERR_NOT_FOUND, http.StatusNotFound
+		}
+		return ERR_UPSTREAM, http.StatusBadGateway
+	}
+	codeErr, ok := biliCode(err)
+	if !ok {
+		return ERR_UPSTREAM, http.StatusBadGateway
+	}
+	switch {
+	case codeErr.Code == -352 || codeErr.Data.VVoucher != "":
+		return ERR_RISK_CONTROL, http.StatusTooManyRequests
+	case codeErr.Code == -412 || codeErr.Code == -509 || codeErr.Code == -799:
+		return ERR_RATE_LIMITED, http.StatusTooManyRequests
+	case codeErr.Code == 6002003,
+		codeErr.Code == -10403 && strings.Contains(codeErr.Message, "地区"):
+		return ERR_REGION_BLOCKED, http.StatusUnavailableForLegalReasons
+	case codeErr.Code == -10403, codeErr.Code == 87007, codeErr.Code == 87008:
+		return ERR_VIP_ONLY, http.StatusPaymentRequired
+	case codeErr.Code == 62002, codeErr.Code == 62004, codeErr.Code == 62012:
+		return ERR_DELETED, http.StatusGone
+	case codeErr.Code == -404:
+		return ERR_NOT_FOUND, http.StatusNotFound
+	}
+	return ERR_UPSTREAM, http.StatusBadGateway
+}
+
+// apiBackoff 触发风控后暂停请求接口, 连续触发时加倍等待
+type apiBackoff struct {
+	mu    sync.Mutex
+	kind  string
+	delay time.Duration
+	until time.Time
+}
+
+var backoff = &apiBackoff{}
+
+// trip 记录一次风控
+func (b *apiBackoff) trip(kind string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// 同一轮中并发的请求只计一次
+	if time.Now().Before(b.until) {
+		return
+	}
+	b.kind = kind
+	b.delay = min(max(b.delay*2, BACKOFF_MIN), BACKOFF_MAX)
+	b.until = time.Now().Add(b.delay)
+	log.Warn().
+		Str("kind", kind).
+		Dur("delay", b.delay).
+		Msg("Bilibili API blocked, backing off")
+}
+
+// succeed 请求成功后恢复
+func (b *apiBackoff) succeed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.delay != 0 && time.Now().After(b.until) {
+		b.delay = 0
+		log.Info().
+			Msg("Bilibili API recovered")
+	}
+}
+
+// remaining 仍需等待的时间
+func (b *apiBackoff) remaining() (string, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.kind, time.Until(b.until)
+}
+
+// apiErrorBody json 错误
+type apiErrorBody struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Code       int    `json:"code,omitempty"` // B站接口返回的 code
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// writeErrorBody 输出 json 错误, 需要等待时附带 Retry-After
+func writeErrorBody(w http.ResponseWriter, status int, body apiErrorBody) {
+	if body.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeAPIError 按错误分类输出, 风控时开始退避
+func writeAPIError(w http.ResponseWriter, err error, msg string) {
+	kind, status := classifyError(err)
+	body := apiErrorBody{
+		Error:   kind,
+		Message: fmt.Sprintf("%s: %v", msg, err),
+	}
+	if codeErr, ok := biliCode(err); ok {
+		body.Code = codeErr.Code
+		body.Message = fmt.Sprintf("%s: %s", msg, codeErr.Message)
+	}
+	if status == http.StatusTooManyRequests {
+		backoff.trip(kind)
+		_, wait := backoff.remaining()
+		body.RetryAfter = int(wait.Seconds()) + 1
+	}
+	log.Error().
+		Err(err).
+		Str("kind", kind).
+		Msg(msg)
+	writeErrorBody(w, status, body)
+}
+
+// checkBackoff 退避期间直接返回 429, 避免播放器反复嗅探加重风控
+func checkBackoff(w http.ResponseWriter) bool {
+	kind, wait := backoff.remaining()
+	if wait <= 0 {
+		return true
+	}
+	writeErrorBody(w, http.StatusTooManyRequests, apiErrorBody{
+		Error:      kind,
+		Message:    "Bilibili API is blocked, retry later",
+		RetryAfter: int(wait.Seconds()) + 1,
+	})
+	return false
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 用户创建的所有收藏夹
+	//	.WithQuery("up_mid", uid)
+	URL_FAV_FOLDER_LIST = `https://api.bilibili.com/x/v3/fav/folder/created/list-all`
+	// 收藏夹内容, 每页最多 20 项
+	//	.WithQuerys("media_id", mediaId, "pn", pn, "ps", "20", "platform", "web")
+	URL_FAV_RESOURCE_LIST = `https://api.bilibili.com/x/v3/fav/resource/list`
+
+	// 收藏夹最多翻页数, 即最多 400 项
+	FAV_MAX_PAGES = 20
+)
+
+type favFolder struct {
+	Id         int    `json:"id"` // media_id
+	Title      string `json:"title"`
+	MediaCount int    `json:"media_count"`
+}
+
+type favMedia struct {
+	Id       int    `json:"id"`   // aid
+	Type     int    `json:"type"` // 2: 视频, 12: 音频, 21: 合集
+	Title    string `json:"title"`
+	Cover    string `json:"cover"`
+	Intro    string `json:"intro"`
+	Page     int    `json:"page"` // 分P数
+	Duration int    `json:"duration"`
+	Upper    struct {
+		Mid  int    `json:"mid"`
+		Name string `json:"name"`
+	} `json:"upper"`
+	Attr    int    `json:"attr"` // 0: 正常, 1 / 9: 已失效
+	Bvid    string `json:"bvid"`
+	PubTime int    `json:"pubtime"`
+}
+
+type favResourceList struct {
+	Info struct {
+		Id         int    `json:"id"`
+		Title      string `json:"title"`
+		Cover      string `json:"cover"`
+		MediaCount int    `json:"media_count"`
+	} `json:"info"`
+	Medias  []favMedia `json:"medias"`
+	HasMore bool       `json:"has_more"`
+}
+
+// fetchFavFolders 获取用户创建的收藏夹
+func fetchFavFolders(uid int) ([]favFolder, error) {
+	req := biligo.Chain{Req: biligo.NewGet(URL_FAV_FOLDER_LIST).
+		WithQuery("up_mid", strconv.Itoa(uid))}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var folders []favFolder
+	err = req.ParseTo(&folders, "data", "list")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return nil, err
+	}
+	return folders, nil
+}
+
+// fetchFavResources 翻页获取收藏夹内容, 最多 FAV_MAX_PAGES 页, 优先从缓存获取
+func fetchFavResources(mediaId string) (*favResourceList, error) {
+	if list, ok := getCached[*favResourceList](playlistCache, "fav/"+mediaId); ok {
+		return list, nil
+	}
+
+	list := &favResourceList{}
+	for pn := 1; pn <= FAV_MAX_PAGES; pn++ {
+		req := biligo.Chain{Req: biligo.NewGet(URL_FAV_RESOURCE_LIST).
+			WithQuerys("media_id", mediaId, "pn", strconv.Itoa(pn), "ps", "20", "platform", "web")}
+		err := doChain(&req)
+		if err != nil {
+			return nil, err
+		}
+		var page favResourceList
+		err = req.ParseTo(&page, "data")
+		if err != nil {
+			return nil, err
+		}
+
+		list.Info = page.Info
+		list.Medias = append(list.Medias, page.Medias...)
+		if !page.HasMore || len(page.Medias) == 0 {
+			break
+		}
+	}
+
+	setCached(playlistCache, "fav/"+mediaId, list, 5*time.Minute)
+	return list, nil
+}
+
+// apiFavFolders 列出当前账号的收藏夹
+func apiFavFolders(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	uid, ok := requireLogin(w)
+	if !ok {
+		return
+	}
+	log.Info().
+		Int("uid", uid).
+		Msg("Fav folders request")
+
+	folders, err := fetchFavFolders(uid)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch fav folders")
+		return
+	}
+
+	if wantJSON(r) {
+		writeJSON(w, folders)
+		return
+	}
+
+	baseUrl := requestBaseUrl(r)
+	items := make([]M3u8Item, len(folders))
+	for i, folder := range folders {
+		items[i] = M3u8Item{
+			Duration: -1,
+			Title:    fmt.Sprintf("%s (%d)", folder.Title, folder.MediaCount),
+			URL:      fmt.Sprintf("%s/v1/fav/%d", baseUrl, folder.Id),
+		}
+	}
+	writeM3U8(w, "fav", M3u8Data{
+		Title: "收藏夹",
+		Items: items,
+	})
+}
+
+// apiFav 收藏夹播放列表,
+// expand=1 时直接展开为各分P的 MPD 地址
+func apiFav(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	mediaId := r.PathValue("mediaId")
+	if _, err := strconv.Atoi(mediaId); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid media id: %s", mediaId)
+		return
+	}
+	if _, ok := requireLogin(w); !ok {
+		return
+	}
+	expand := r.URL.Query().Get("expand") == "1"
+	log.Info().
+		Str("mediaId", mediaId).
+		Bool("expand", expand).
+		Msg("Fav playlist request")
+
+	list, err := fetchFavResources(mediaId)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch fav resources")
+		return
+	}
+
+	baseUrl := requestBaseUrl(r)
+	var items []M3u8Item
+	for _, media := range list.Medias {
+		if media.Type != 2 || media.Attr != 0 {
+			items = append(items, M3u8Item{
+				Comment: fmt.Sprintf("skipped: %s %s (type %d, attr %d)", media.Bvid, media.Title, media.Type, media.Attr),
+			})
+			continue
+		}
+		items = append(items, listVideoItems(baseUrl, media.Bvid, media.Page, expand, M3u8Item{
+			Duration:    media.Duration,
+			Title:       media.Title,
+			Cover:       imageProxyUrl(baseUrl, media.Cover, 0, 0),
+			Group:       list.Info.Title,
+			Owner:       media.Upper.Name,
+			Bvid:        media.Bvid,
+			PubDate:     media.PubTime,
+			Description: media.Intro,
+		})...)
+	}
+
+	data := M3u8Data{
+		Title: list.Info.Title,
+		Cover: imageProxyUrl(baseUrl, list.Info.Cover, 0, 0),
+		Items: items,
+	}
+	if wantJSON(r) {
+		writeJSON(w, data)
+		return
+	}
+	writeM3U8(w, "fav_"+mediaId, data)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 首页推荐, 需要 wbi 签名, 登录后为个性化推荐
+	//	.WithQuerys("fresh_type", "4", "ps", ps, "fresh_idx", idx, "feed_version", "V8")
+	URL_FEED_RCMD_WBI = `https://api.bilibili.com/x/web-interface/wbi/index/top/feed/rcmd`
+	// 热门
+	//	.WithQuerys("pn", pn, "ps", ps)
+	URL_POPULAR = `https://api.bilibili.com/x/web-interface/popular`
+	// 排行榜, rid 为分区 id, 0 为全站
+	//	.WithQuerys("rid", rid, "type", "all")
+	URL_RANKING = `https://api.bilibili.com/x/web-interface/ranking/v2`
+	// 动态, 需要登录
+	//	.WithQuerys("type", "video", "offset", offset)
+	URL_DYNAMIC_FEED = `https://api.bilibili.com/x/polymer/web-dynamic/v1/feed/all`
+)
+
+const (
+	FEED_PAGE_SIZE = 20
+	// 单次请求最多返回的数量与翻页次数,
+	// 推荐与动态没有尽头, 且动态的一页中可能只有少量视频
+	FEED_MAX_LIMIT = 200
+	FEED_MAX_PAGES = 20
+)
+
+// feedVideo 各列表接口中的视频, 字段按热门/排行榜接口命名
+type feedVideo struct {
+	Aid      int    `json:"aid"`
+	Bvid     string `json:"bvid"`
+	Title    string `json:"title"`
+	Pic      string `json:"pic"`
+	Desc     string `json:"desc"`
+	Duration int    `json:"duration"`
+	PubDate  int    `json:"pubdate"`
+	Videos   int    `json:"videos"` // 分P数, 推荐接口不返回
+	Owner    struct {
+		Name string `json:"name"`
+	} `json:"owner"`
+	Goto string `json:"goto"` // 推荐接口: av, ad, live...
+}
+
+// fetchRecommend 获取首页推荐, 不缓存
+func fetchRecommend(ps, idx int) ([]feedVideo, error) {
+	req := biligo.Chain{Req: biligo.NewGet(URL_FEED_RCMD_WBI).WbiSign().
+		WithQuerys("fresh_type", "4", "ps", strconv.Itoa(ps), "fresh_idx", strconv.Itoa(idx), "feed_version", "V8")}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var items []feedVideo
+	err = req.ParseTo(&items, "data", "item")
+	if err != nil {
+		return nil, err
+	}
+	videos := items[:0]
+	for _, v := range items {
+		// 跳过广告和直播
+		if v.Goto == "av" && v.Bvid != "" {
+			videos = append(videos, v)
+		}
+	}
+	return videos, nil
+}
+
+// fetchPopular 获取热门的第 pn 页, 优先从缓存获取
+func fetchPopular(pn int) ([]feedVideo, error) {
+	key := fmt.Sprintf("popular/%d", pn)
+	if videos, ok := getCached[[]feedVideo](playlistCache, key); ok {
+		return videos, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_POPULAR).
+		WithQuerys("pn", strconv.Itoa(pn), "ps", strconv.Itoa(FEED_PAGE_SIZE))}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var videos []feedVideo
+	err = req.ParseTo(&videos, "data", "list")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return nil, err
+	}
+
+	setCached(playlistCache, key, videos, 10*time.Minute)
+	return videos, nil
+}
+
+// fetchRanking 获取分区排行榜, 优先从缓存获取
+func fetchRanking(rid string) ([]feedVideo, error) {
+	key := "ranking/" + rid
+	if videos, ok := getCached[[]feedVideo](playlistCache, key); ok {
+		return videos, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_RANKING).WbiSign().
+		WithQuerys("rid", rid, "type", "all")}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var videos []feedVideo
+	err = req.ParseTo(&videos, "data", "list")
+	if err != nil {
+		return nil, err
+	}
+
+	setCached(playlistCache, key, videos, 30*time.Minute)
+	return videos, nil
+}
+
+type dynamicItem struct {
+	Modules struct {
+		ModuleAuthor struct {
+			Name  string `json:"name"`
+			PubTs int    `json:"pub_ts"`
+		} `json:"module_author"`
+		ModuleDynamic struct {
+			Major struct {
+				Archive *struct {
+					Aid          string `json:"aid"`
+					Bvid         string `json:"bvid"`
+					Title        string `json:"title"`
+					Cover        string `json:"cover"`
+					Desc         string `json:"desc"`
+					DurationText string `json:"duration_text"` // "mm:ss"
+				} `json:"archive"`
+			} `json:"major"`
+		} `json:"module_dynamic"`
+	} `json:"modules"`
+}
+
+// fetchDynamic 获取关注的 UP 主发布的视频动态, offset 为空时从最新开始,
+// 返回下一页的 offset, 没有更多时为空
+func fetchDynamic(offset string) (videos []feedVideo, next string, err error) {
+	key := "dynamic/" + offset
+	type page struct {
+		Videos []feedVideo
+		Next   string
+	}
+	if p, ok := getCached[page](playlistCache, key); ok {
+		return p.Videos, p.Next, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_DYNAMIC_FEED).
+		WithQuerys("type", "video", "offset", offset)}
+	err = doChain(&req)
+	if err != nil {
+		return nil, "", err
+	}
+	var data struct {
+		Items   []dynamicItem `json:"items"`
+		Offset  string        `json:"offset"`
+		HasMore bool          `json:"has_more"`
+	}
+	err = req.ParseTo(&data, "data")
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, item := range data.Items {
+		archive := item.Modules.ModuleDynamic.Major.Archive
+		if archive == nil {
+			continue
+		}
+		aid, _ := strconv.Atoi(archive.Aid)
+		v := feedVideo{
+			Aid:      aid,
+			Bvid:     archive.Bvid,
+			Title:    archive.Title,
+			Pic:      archive.Cover,
+			Desc:     archive.Desc,
+			Duration: parseLength(archive.DurationText),
+			PubDate:  item.Modules.ModuleAuthor.PubTs,
+		}
+		v.Owner.Name = item.Modules.ModuleAuthor.Name
+		videos = append(videos, v)
+	}
+	if data.HasMore {
+		next = data.Offset
+	}
+
+	setCached(playlistCache, key, page{videos, next}, 2*time.Minute)
+	return videos, next, nil
+}
+
+// writeFeedVideos 输出列表接口的视频, 时长与标题直接取自列表,
+// 不逐个获取视频信息 (expand=1 时除外)
+func writeFeedVideos(w http.ResponseWriter, r *http.Request, filename, title string, videos []feedVideo) {
+	expand := r.URL.Query().Get("expand") == "1"
+	baseUrl := requestBaseUrl(r)
+
+	var items []M3u8Item
+	for _, v := range videos {
+		items = append(items, listVideoItems(baseUrl, v.Bvid, v.Videos, expand, M3u8Item{
+			Duration:    v.Duration,
+			Title:       v.Title,
+			Cover:       imageProxyUrl(baseUrl, v.Pic, 0, 0),
+			Group:       title,
+			Owner:       v.Owner.Name,
+			Bvid:        v.Bvid,
+			PubDate:     v.PubDate,
+			Description: v.Desc,
+		})...)
+	}
+
+	data := M3u8Data{
+		Title: title,
+		Items: items,
+	}
+	if wantJSON(r) {
+		writeJSON(w, data)
+		return
+	}
+	writeM3U8(w, filename, data)
+}
+
+// parseFeedLimit 解析 query limit, 默认 20, 不超过 FEED_MAX_LIMIT
+func parseFeedLimit(s string) int {
+	limit, _ := strconv.Atoi(s)
+	if limit <= 0 {
+		return FEED_PAGE_SIZE
+	}
+	return min(limit, FEED_MAX_LIMIT)
+}
+
+// apiRecommend 首页推荐, 登录后为个性化推荐,
+// limit: 数量 (默认 20, 不超过 200)
+func apiRecommend(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	limit := parseFeedLimit(r.URL.Query().Get("limit"))
+	log.Info().
+		Int("limit", limit).
+		Msg("Recommend request")
+
+	var videos []feedVideo
+	for idx := 1; len(videos) < limit && idx <= FEED_MAX_PAGES; idx++ {
+		page, err := fetchRecommend(min(limit, 30), idx)
+		if err != nil {
+			writeAPIError(w, err, "Failed to fetch feed")
+			return
+		}
+		if len(page) == 0 {
+			break
+		}
+		videos = append(videos, page...)
+	}
+	videos = videos[:min(len(videos), limit)]
+
+	writeFeedVideos(w, r, "recommend", "推荐", videos)
+}
+
+// apiPopular 热门,
+// page: 起始页, limit: 数量 (默认 20, 不超过 200)
+func apiPopular(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	page = max(page, 1)
+	limit := parseFeedLimit(query.Get("limit"))
+	log.Info().
+		Int("page", page).
+		Int("limit", limit).
+		Msg("Popular request")
+
+	var videos []feedVideo
+	for pn := page; len(videos) < limit && pn < page+FEED_MAX_PAGES; pn++ {
+		pageVideos, err := fetchPopular(pn)
+		if err != nil {
+			writeAPIError(w, err, "Failed to fetch feed")
+			return
+		}
+		videos = append(videos, pageVideos...)
+		if len(pageVideos) < FEED_PAGE_SIZE {
+			break
+		}
+	}
+	videos = videos[:min(len(videos), limit)]
+
+	writeFeedVideos(w, r, "popular", "热门", videos)
+}
+
+// apiRanking 分区排行榜, rid 为 0 时为全站
+func apiRanking(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	rid := r.PathValue("rid")
+	if _, err := strconv.Atoi(rid); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid rid: %s", rid)
+		return
+	}
+	log.Info().
+		Str("rid", rid).
+		Msg("Ranking request")
+
+	videos, err := fetchRanking(rid)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch feed")
+		return
+	}
+
+	writeFeedVideos(w, r, "ranking_"+rid, "排行榜", videos)
+}
+
+// apiDynamic 关注的 UP 主发布的视频, 需要登录,
+// limit: 数量 (默认 20, 不超过 200)
+func apiDynamic(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	if _, ok := requireLogin(w); !ok {
+		return
+	}
+	limit := parseFeedLimit(r.URL.Query().Get("limit"))
+	log.Info().
+		Int("limit", limit).
+		Msg("Dynamic request")
+
+	var videos []feedVideo
+	offset := ""
+	for range FEED_MAX_PAGES {
+		if len(videos) >= limit {
+			break
+		}
+		pageVideos, next, err := fetchDynamic(offset)
+		if err != nil {
+			writeAPIError(w, err, "Failed to fetch feed")
+			return
+		}
+		videos = append(videos, pageVideos...)
+		if next == "" {
+			break
+		}
+		offset = next
+	}
+	videos = videos[:min(len(videos), limit)]
+
+	writeFeedVideos(w, r, "dynamic", "动态", videos)
+}
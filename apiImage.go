@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	netUrl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const IMAGE_CACHE_TTL = 7 * 24 * time.Hour
+
+var imageCacheDir string
+
+// initImageCache 确定图片缓存目录, 不可用时禁用缓存
+func initImageCache() {
+	switch *fImageCache {
+	case "off":
+		return
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Msg("Failed to get user cache dir, image cache disabled")
+			return
+		}
+		imageCacheDir = filepath.Join(dir, "BiliProxyM3U8", "images")
+	default:
+		imageCacheDir = *fImageCache
+	}
+
+	err := os.MkdirAll(imageCacheDir, 0o755)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("dir", imageCacheDir).
+			Msg("Failed to create image cache dir, image cache disabled")
+		imageCacheDir = ""
+		return
+	}
+	log.Debug().
+		Str("dir", imageCacheDir).
+		Msg("Image cache enabled")
+}
+
+// biliImageUrl 为B站图片 url 附加缩放后缀, 如 `@320w_180h_1c.webp`
+func biliImageUrl(src string, width, height int, format string) string {
+	if strings.HasPrefix(src, "//") {
+		src = "https:" + src
+	} else if strings.HasPrefix(src, "http://") {
+		src = "https://" + src[len("http://"):]
+	}
+	if width <= 0 && height <= 0 && format == "" {
+		return src
+	}
+
+	var parts []string
+	if width > 0 {
+		parts = append(parts, strconv.Itoa(width)+"w")
+	}
+	if height > 0 {
+		parts = append(parts, strconv.Itoa(height)+"h")
+	}
+	if width > 0 && height > 0 {
+		parts = append(parts, "1c") // 裁剪而非拉伸
+	}
+	if format == "" {
+		format = "webp"
+	}
+	return src + "@" + strings.Join(parts, "_") + "." + format
+}
+
+// imageProxyUrl 生成经由本服务代理的图片地址
+func imageProxyUrl(baseUrl, src string, width, height int) string {
+	if src == "" {
+		return ""
+	}
+	query := netUrl.Values{"url": {src}}
+	if width > 0 {
+		query.Set("w", strconv.Itoa(width))
+	}
+	if height > 0 {
+		query.Set("h", strconv.Itoa(height))
+	}
+	return baseUrl + "/v1/image?" + query.Encode()
+}
+
+// isBiliImageHost 只代理B站图床, 避免成为开放代理
+func isBiliImageHost(host string) bool {
+	return host == "hdslb.com" || strings.HasSuffix(host, ".hdslb.com") ||
+		host == "biliimg.com" || strings.HasSuffix(host, ".biliimg.com")
+}
+
+// apiImage 代理封面/头像等图片,
+// 支持 w, h, format (webp, jpg, png, avif) 缩放参数
+func apiImage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	src := query.Get("url")
+	width, _ := strconv.Atoi(query.Get("w"))
+	height, _ := strconv.Atoi(query.Get("h"))
+	format := strings.ToLower(query.Get("format"))
+
+	switch format {
+	case "", "webp", "jpg", "png", "avif":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown format: %s", format)
+		return
+	}
+
+	url := biliImageUrl(src, width, height, format)
+	u, err := netUrl.Parse(url)
+	if err != nil || !isBiliImageHost(u.Hostname()) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid image url: %s", src)
+		return
+	}
+
+	log.Debug().
+		Str("url", url).
+		Msg("Image request")
+
+	var cachePath string
+	if imageCacheDir != "" {
+		sum := sha1.Sum([]byte(url))
+		cachePath = filepath.Join(imageCacheDir, hex.EncodeToString(sum[:]))
+		if serveCachedImage(w, r, cachePath) {
+			return
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(r.Context(), "GET", url, nil)
+	for k, v := range biligo.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("url", url).
+			Msg("Image request failed")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Warn().
+			Int("status", resp.StatusCode).
+			Str("url", url).
+			Msg("Image response")
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("url", url).
+			Msg("Failed to read image")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if cachePath != "" {
+		err = writeImageCache(cachePath, body)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("path", cachePath).
+				Msg("Failed to write image cache")
+		}
+	}
+
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set("Cache-Control", "public, max-age=86400") // 24 hours
+	w.Write(body)
+}
+
+// writeImageCache 先写入临时文件再替换, 避免并发读取到不完整的图片
+func writeImageCache(path string, body []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// cleanupImageCache 删除过期的图片缓存
+func cleanupImageCache() {
+	if imageCacheDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(imageCacheDir)
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < IMAGE_CACHE_TTL {
+			continue
+		}
+		if os.Remove(filepath.Join(imageCacheDir, entry.Name())) == nil {
+			removed++
+		}
+	}
+	log.Debug().
+		Int("removed", removed).
+		Msg("Image cache cleanup completed")
+}
+
+// serveCachedImage 命中未过期的缓存时直接响应
+func serveCachedImage(w http.ResponseWriter, r *http.Request, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || time.Since(stat.ModTime()) > IMAGE_CACHE_TTL {
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400") // 24 hours
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+	return true
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 互动视频的剧情节点, edge_id 为 0 时为起始节点
+//
+//	.WithQuerys("aid", aid, "graph_version", graphVersion, "edge_id", edgeId)
+const URL_STEIN_EDGE_INFO = `https://api.bilibili.com/x/stein/edgeinfo_v2`
+
+const (
+	// 按默认选项走的路径最多的节点数, 避免循环剧情
+	INTERACTIVE_MAX_PATH = 50
+	// 遍历剧情图时最多请求的节点数
+	INTERACTIVE_MAX_GRAPH = 200
+)
+
+type steinChoice struct {
+	EdgeId    int    `json:"id"`
+	Cid       int    `json:"cid"`
+	Option    string `json:"option"`
+	IsDefault int    `json:"is_default"`
+	IsHidden  int    `json:"is_hidden"`
+	Condition string `json:"condition"` // 依赖隐藏变量的条件, 不处理
+}
+
+type steinEdgeInfo struct {
+	Title  string `json:"title"`
+	EdgeId int    `json:"edge_id"`
+	Edges  struct {
+		Questions []struct {
+			Title   string        `json:"title"`
+			Choices []steinChoice `json:"choices"`
+		} `json:"questions"`
+	} `json:"edges"`
+	IsLeaf int `json:"is_leaf"`
+}
+
+// choices 当前节点可选的后续节点, 多个问题时只取第一个
+func (info *steinEdgeInfo) choices() []steinChoice {
+	if info.IsLeaf == 1 || len(info.Edges.Questions) == 0 {
+		return nil
+	}
+	choices := make([]steinChoice, 0, len(info.Edges.Questions[0].Choices))
+	for _, c := range info.Edges.Questions[0].Choices {
+		if c.IsHidden == 0 && c.Cid != 0 {
+			choices = append(choices, c)
+		}
+	}
+	return choices
+}
+
+// interactiveNode 剧情图中的一个节点
+type interactiveNode struct {
+	EdgeId  int                 `json:"edge_id"`
+	Cid     int                 `json:"cid"`
+	Title   string              `json:"title"`
+	Choices []interactiveChoice `json:"choices,omitempty"`
+}
+
+type interactiveChoice struct {
+	EdgeId  int    `json:"edge_id"`
+	Cid     int    `json:"cid"`
+	Option  string `json:"option"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// fetchGraphVersion 获取互动视频的剧情图版本, 非互动视频时返回 0
+func fetchGraphVersion(aid, cid int) (int, error) {
+	key := fmt.Sprintf("graph/%d", aid)
+	if version, ok := getCached[int](playlistCache, key); ok {
+		return version, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_PLAYER_V2_WBI).WbiSign().
+		WithQuerys("aid", strconv.Itoa(aid), "cid", strconv.Itoa(cid))}
+	err := doChain(&req)
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = req.ParseTo(&version, "data", "interaction", "graph_version")
+	if err != nil {
+		if biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	setCached(playlistCache, key, version, 30*time.Minute)
+	return version, nil
+}
+
+// fetchEdgeInfo 获取剧情节点, 优先从缓存获取
+func fetchEdgeInfo(aid, graphVersion, edgeId int) (*steinEdgeInfo, error) {
+	key := fmt.Sprintf("stein/%d/%d/%d", aid, graphVersion, edgeId)
+	if info, ok := getCached[*steinEdgeInfo](playlistCache, key); ok {
+		return info, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_STEIN_EDGE_INFO).
+		WithQuerys("aid", strconv.Itoa(aid), "graph_version", strconv.Itoa(graphVersion), "edge_id", strconv.Itoa(edgeId))}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	info := &steinEdgeInfo{}
+	err = req.ParseTo(info, "data")
+	if err != nil {
+		return nil, err
+	}
+
+	setCached(playlistCache, key, info, 30*time.Minute)
+	return info, nil
+}
+
+// interactiveGraph 从起始节点遍历剧情图
+func interactiveGraph(vInfo *biligo.VideoInfo, graphVersion int) ([]interactiveNode, error) {
+	start := interactiveNode{Cid: vInfo.Pages[0].Cid}
+	queue := []interactiveNode{start}
+	seen := map[int]bool{}
+	var nodes []interactiveNode
+
+	for len(queue) > 0 && len(nodes) < INTERACTIVE_MAX_GRAPH {
+		node := queue[0]
+		queue = queue[1:]
+		info, err := fetchEdgeInfo(vInfo.Aid, graphVersion, node.EdgeId)
+		if err != nil {
+			return nil, err
+		}
+		node.EdgeId = info.EdgeId
+		if seen[node.EdgeId] {
+			continue
+		}
+		seen[node.EdgeId] = true
+		node.Title = info.Title
+
+		for _, c := range info.choices() {
+			node.Choices = append(node.Choices, interactiveChoice{
+				EdgeId:  c.EdgeId,
+				Cid:     c.Cid,
+				Option:  c.Option,
+				Default: c.IsDefault == 1,
+			})
+			if !seen[c.EdgeId] {
+				queue = append(queue, interactiveNode{EdgeId: c.EdgeId, Cid: c.Cid})
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// interactivePath 按 choices (每个节点所选选项的序号, 从 0 开始) 走出一条路径,
+// 未指定的节点取默认选项, 没有默认时取第一个
+func interactivePath(vInfo *biligo.VideoInfo, graphVersion int, choices []int) ([]interactiveNode, error) {
+	node := interactiveNode{Cid: vInfo.Pages[0].Cid}
+	var path []interactiveNode
+
+	for i := 0; i < INTERACTIVE_MAX_PATH; i++ {
+		info, err := fetchEdgeInfo(vInfo.Aid, graphVersion, node.EdgeId)
+		if err != nil {
+			return nil, err
+		}
+		node.EdgeId, node.Title = info.EdgeId, info.Title
+		path = append(path, node)
+
+		options := info.choices()
+		if len(options) == 0 {
+			break
+		}
+		choice := options[0]
+		if i < len(choices) {
+			if choices[i] < 0 || choices[i] >= len(options) {
+				return nil, fmt.Errorf("choice %d out of range %d at node %d", choices[i], len(options), i)
+			}
+			choice = options[choices[i]]
+		} else {
+			for _, c := range options {
+				if c.IsDefault == 1 {
+					choice = c
+					break
+				}
+			}
+		}
+		node = interactiveNode{EdgeId: choice.EdgeId, Cid: choice.Cid}
+	}
+	return path, nil
+}
+
+// parseChoices 解析 "0,1,0" 格式的选项序号
+func parseChoices(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var choices []int
+	for part := range strings.SplitSeq(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid choice %q", part)
+		}
+		choices = append(choices, n)
+	}
+	return choices, nil
+}
+
+// apiInteractive 互动视频,
+// format: mpd (默认, 所选路径合并为多 Period), m3u8 (每个节点一项), json (剧情图),
+// choices: 每个节点所选选项的序号, 如 "0,1,0", 不指定时走默认选项,
+// edge (与 cid): 只输出该节点的 MPD
+func apiInteractive(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	query := r.URL.Query()
+	format := query.Get("format")
+	log.Info().
+		Str("id", id).
+		Str("format", format).
+		Str("choices", query.Get("choices")).
+		Str("edge", query.Get("edge")).
+		Msg("Interactive request")
+
+	if !checkBackoff(w) {
+		return
+	}
+
+	account, err := requestAccount(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
+	}
+	if len(vInfo.Pages) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "No pages in %s", id)
+		return
+	}
+	graphVersion, err := fetchGraphVersion(vInfo.Aid, vInfo.Pages[0].Cid)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch graph version")
+		return
+	}
+	if graphVersion == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s is not an interactive video", id)
+		return
+	}
+
+	if format == "json" {
+		nodes, err := interactiveGraph(vInfo, graphVersion)
+		if err != nil {
+			writeAPIError(w, err, "Failed to fetch interactive graph")
+			return
+		}
+		writeJSON(w, nodes)
+		return
+	}
+
+	var path []interactiveNode
+	if edge := query.Get("edge"); edge != "" {
+		edgeId, err := strconv.Atoi(edge)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid edge: %s", edge)
+			return
+		}
+		info, err := fetchEdgeInfo(vInfo.Aid, graphVersion, edgeId)
+		if isBiliError(err) {
+			writeAPIError(w, err, fmt.Sprintf("Failed to fetch edge %d", edgeId))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Failed to fetch edge %d: %v", edgeId, err)
+			return
+		}
+		// 节点的 cid 只在上一个节点的选项中, 未在 query 中指定时借用剧情图查找
+		cid, _ := strconv.Atoi(query.Get("cid"))
+		switch {
+		case cid != 0:
+		case edgeId == 0:
+			cid = vInfo.Pages[0].Cid
+		default:
+			nodes, err := interactiveGraph(vInfo, graphVersion)
+			if err == nil {
+				for _, n := range nodes {
+					if n.EdgeId == info.EdgeId {
+						cid = n.Cid
+						break
+					}
+				}
+			}
+		}
+		if cid == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Edge %d not found", edgeId)
+			return
+		}
+		path = []interactiveNode{{EdgeId: info.EdgeId, Cid: cid, Title: info.Title}}
+	} else {
+		choices, err := parseChoices(query.Get("choices"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		path, err = interactivePath(vInfo, graphVersion, choices)
+		if isBiliError(err) {
+			writeAPIError(w, err, "Failed to walk interactive path")
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Failed to walk interactive path")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+	}
+
+	baseUrl := requestBaseUrl(r)
+	switch format {
+	case "m3u8":
+		items := make([]M3u8Item, len(path))
+		for i, node := range path {
+			items[i] = M3u8Item{
+				Title: node.Title,
+				Cover: imageProxyUrl(baseUrl, vInfo.Pic, 0, 0),
+				URL:   fmt.Sprintf("%s/v1/interactive/%s?edge=%d&cid=%d", baseUrl, id, node.EdgeId, node.Cid),
+				Group: vInfo.Title,
+				Owner: vInfo.Owner.Name,
+				Bvid:  vInfo.Bvid,
+				Cid:   node.Cid,
+			}
+			if account := query.Get("account"); account != "" {
+				items[i].URL = appendQuery(items[i].URL, "account", account)
+			}
+		}
+		writeM3U8(w, "interactive_"+id, M3u8Data{
+			Title: vInfo.Title,
+			Cover: imageProxyUrl(baseUrl, vInfo.Pic, 0, 0),
+			Items: items,
+		})
+
+	case "", "mpd":
+		periods := make([]PeriodData, 0, len(path))
+		totalDuration := 0
+		for _, node := range path {
+			// 缩略图接口按分P索引, 互动视频的节点不在分P中, 不附带缩略图
+			period, err := buildCidPeriod(vInfo.Aid, node.Cid, 0, account)
+			if err != nil {
+				writeAPIError(w, err, fmt.Sprintf("Failed to build period %s", node.Title))
+				return
+			}
+			period.Title = node.Title
+			period.Start = totalDuration
+			totalDuration += period.Duration
+			periods = append(periods, period)
+		}
+
+		title := vInfo.Title
+		if len(path) == 1 {
+			title = fmt.Sprintf("%s - %s", vInfo.Title, path[0].Title)
+		}
+		writeMPD(w, MpdData{
+			Title:         title,
+			CoverURL:      imageProxyUrl(baseUrl, vInfo.Pic, 0, 0),
+			OwnerName:     vInfo.Owner.Name,
+			Aid:           vInfo.Aid,
+			Bvid:          vInfo.Bvid,
+			TotalDuration: totalDuration,
+			AudioOnly:     audioOnly(r),
+			Periods:       periods,
+		})
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown format: %s", format)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	regShort   = regexp.MustCompile(biligo.REGEXP_SHORT)
+	regVideo   = regexp.MustCompile(biligo.REGEXP_VIDEO)
+	regBangumi = regexp.MustCompile(biligo.REGEXP_BANGUMI)
+	regAudio   = regexp.MustCompile(biligo.REGEXP_AUDIO)
+	// 分享文案/手动输入中不带链接的 id
+	regBareId = regexp.MustCompile(`\b(BV1[1-9A-HJ-NP-Za-km-z]{9}|av[0-9]+|au[0-9]+|(?:ep|ss|md)[0-9]+)\b`)
+	regUrl    = regexp.MustCompile(`https?://[^\s"'<>【】]+`)
+)
+
+// 不跟随重定向, 用于解析短链
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(_ *http.Request, _ []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// resolvedLink 从链接中解析出的视频
+type resolvedLink struct {
+	Id    string // av/BV/au 号
+	Page  string // 分P, 为空时不指定
+	Start int    // 开始时间, 秒
+}
+
+// resolveLink 解析完整链接, b23.tv 短链, 番剧链接, 分享文案或裸 id
+func resolveLink(s string) (*resolvedLink, error) {
+	s = strings.TrimSpace(s)
+
+	// 短链最多跟随几次
+	for range 3 {
+		m := regShort.FindString(s)
+		if m == "" {
+			break
+		}
+		loc, err := followShortLink("https://" + m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to follow short link: %w", err)
+		}
+		s = loc
+	}
+
+	link := &resolvedLink{}
+	// 分P与开始时间取自链接的 query
+	if u := regUrl.FindString(s); u != "" {
+		if parsed, err := netUrl.Parse(u); err == nil {
+			query := parsed.Query()
+			if p, err := strconv.Atoi(query.Get("p")); err == nil && p > 0 {
+				link.Page = strconv.Itoa(p)
+			}
+			if t, err := strconv.ParseFloat(query.Get("t"), 64); err == nil && t > 0 {
+				link.Start = int(t)
+			}
+		}
+	}
+
+	switch {
+	case regVideo.MatchString(s):
+		link.Id = regVideo.FindStringSubmatch(s)[biligo.REGEXP_INDEX_ARCHIVE]
+	case regBangumi.MatchString(s):
+		aid, err := resolveBangumi(regBangumi.FindStringSubmatch(s)[biligo.REGEXP_INDEX_BANGUMI_ID])
+		if err != nil {
+			return nil, err
+		}
+		link.Id = aid
+	case regAudio.MatchString(s):
+		link.Id = "au" + regAudio.FindStringSubmatch(s)[biligo.REGEXP_INDEX_AUDIO]
+	case regBareId.MatchString(s):
+		id := regBareId.FindString(s)
+		switch id[:2] {
+		case "ep", "ss", "md":
+			aid, err := resolveBangumi(id)
+			if err != nil {
+				return nil, err
+			}
+			id = aid
+		}
+		link.Id = id
+	default:
+		return nil, fmt.Errorf("no video found in: %s", s)
+	}
+	return link, nil
+}
+
+// followShortLink 对短链发送 HEAD 请求, 返回重定向地址
+func followShortLink(url string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range biligo.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := noRedirectClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", fmt.Errorf("no redirect location, status: %d", resp.StatusCode)
+	}
+	return loc, nil
+}
+
+// fetchMedia 请求番剧信息, 代替 biligo.FetchMediaInfo* 以便分类错误
+func fetchMedia(req *biligo.Request) (biligo.Media, error) {
+	c := biligo.Chain{Req: req}
+	err := doChain(&c)
+	if err != nil {
+		return biligo.Media{}, err
+	}
+	return c.ToMedia()
+}
+
+// resolveBangumi 将番剧的 ep/ss/md 号解析为对应剧集的 av 号,
+// ss/md 取第一集
+func resolveBangumi(id string) (string, error) {
+	var (
+		media biligo.Media
+		err   error
+	)
+	switch id[:2] {
+	case "ep":
+		media, err = fetchMedia(biligo.ReqMediaInfoEpid(id))
+	case "md":
+		req := biligo.Chain{Req: biligo.ReqMediaInfoBase(id)}
+		err = doChain(&req)
+		if err != nil {
+			break
+		}
+		var base biligo.MediaBase
+		base, err = req.ToMediaBase()
+		if err != nil {
+			break
+		}
+		if base.Media.SeasonId == 0 {
+			return "", fmt.Errorf("no season found for %s", id)
+		}
+		media, err = fetchMedia(biligo.ReqMediaInfoSsid("ss" + strconv.Itoa(base.Media.SeasonId)))
+	default:
+		media, err = fetchMedia(biligo.ReqMediaInfoSsid(id))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch bangumi info: %w", err)
+	}
+	if len(media.Episodes) == 0 {
+		return "", fmt.Errorf("no episode found for %s", id)
+	}
+
+	if epid, ok := strings.CutPrefix(id, "ep"); ok {
+		for _, ep := range media.Episodes {
+			if strconv.Itoa(ep.Id) == epid {
+				return "av" + strconv.Itoa(ep.Aid), nil
+			}
+		}
+	}
+	return "av" + strconv.Itoa(media.Episodes[0].Aid), nil
+}
+
+// location 解析结果对应的本服务地址, query 中的其他参数原样保留
+func (link *resolvedLink) location(query netUrl.Values) string {
+	location := "/v1/video/" + link.Id
+	if strings.HasPrefix(link.Id, "au") {
+		location = "/v1/audio/" + link.Id
+	} else if link.Page != "" && !query.Has("p") {
+		query.Set("p", link.Page)
+	}
+	if link.Start > 0 && !query.Has("t") {
+		query.Set("t", strconv.Itoa(link.Start))
+	}
+	if len(query) > 0 {
+		location += "?" + query.Encode()
+	}
+	return location
+}
+
+// apiOpen 解析任意B站链接或分享文案, 重定向到对应的 M3U8 / MPD
+func apiOpen(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	s := query.Get("url")
+	if s == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty url")
+		return
+	}
+	query.Del("url")
+
+	if !checkBackoff(w) {
+		return
+	}
+
+	link, err := resolveLink(s)
+	if isBiliError(err) {
+		writeAPIError(w, err, "Failed to resolve link")
+		return
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("url", s).
+			Msg("Failed to resolve link")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	location := link.location(query)
+	log.Info().
+		Str("url", s).
+		Str("location", location).
+		Msg("Open request")
+	http.Redirect(w, r, location, http.StatusFound)
+}
@@ -13,7 +13,12 @@ import (
 
 func apiProxy(w http.ResponseWriter, r *http.Request) {
 	url, _ := netUrl.QueryUnescape(r.URL.Query().Get("url"))
+	trackRange(url, r.Header.Get("Range"))
+	proxyUpstream(w, r, url)
+}
 
+// proxyUpstream 带上B站请求头转发 url, 透传 Range
+func proxyUpstream(w http.ResponseWriter, r *http.Request, url string) {
 	rangeHeader := r.Header.Get("Range")
 	log.Debug().
 		Str("url", url).
@@ -55,6 +60,11 @@ func apiProxy(w http.ResponseWriter, r *http.Request) {
 		Str("accept-ranges", resp.Header.Get("Accept-Ranges")).
 		Msg("Proxy response")
 
+	// 流地址返回 412/429 时同样是风控, 暂停请求接口
+	if kind, status := classifyError(&biliStatusError{StatusCode: resp.StatusCode}); status == http.StatusTooManyRequests {
+		backoff.trip(kind)
+	}
+
 	maps.Copy(w.Header(), resp.Header)
 
 	// Add caching headers to encourage client-side caching
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 分类搜索, 需要 wbi 签名
+//
+//	.WithQuerys("search_type", "video", "keyword", keyword, "order", order, "duration", duration, "page", page)
+//
+// order: totalrank (默认), click, pubdate, dm, stow, scores
+//
+// duration: 0 全部, 1 10分钟以下, 2 10-30分钟, 3 30-60分钟, 4 60分钟以上
+const URL_SEARCH_TYPE_WBI = `https://api.bilibili.com/x/web-interface/wbi/search/type`
+
+type searchVideo struct {
+	Aid         int    `json:"aid"`
+	Bvid        string `json:"bvid"`
+	Title       string `json:"title"` // 关键词带 <em class="keyword"> 高亮
+	Pic         string `json:"pic"`   // 无协议头 "//i0.hdslb.com/..."
+	Author      string `json:"author"`
+	Description string `json:"description"`
+	Duration    string `json:"duration"` // "m:ss", 分钟数可能超过 60
+	PubDate     int    `json:"pubdate"`
+}
+
+var searchTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// stripSearchHighlight 去掉搜索结果中的高亮标签
+func stripSearchHighlight(s string) string {
+	return html.UnescapeString(searchTagRegexp.ReplaceAllString(s, ""))
+}
+
+// fetchSearchVideos 搜索视频, 优先从缓存获取
+func fetchSearchVideos(keyword, order, duration string, page int) ([]searchVideo, error) {
+	key := fmt.Sprintf("search/%s/%s/%s/%d", keyword, order, duration, page)
+	if videos, ok := getCached[[]searchVideo](playlistCache, key); ok {
+		return videos, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_SEARCH_TYPE_WBI).WbiSign().
+		WithQuerys(
+			"search_type", "video", "keyword", keyword,
+			"order", order, "duration", duration, "page", strconv.Itoa(page),
+		)}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var videos []searchVideo
+	err = req.ParseTo(&videos, "data", "result")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return nil, err
+	}
+	for i := range videos {
+		videos[i].Title = stripSearchHighlight(videos[i].Title)
+		if strings.HasPrefix(videos[i].Pic, "//") {
+			videos[i].Pic = "https:" + videos[i].Pic
+		}
+	}
+
+	setCached(playlistCache, key, videos, 10*time.Minute)
+	return videos, nil
+}
+
+// apiSearch 搜索视频,
+// q: 关键词, order: totalrank (默认), click, pubdate, dm, stow, scores,
+// duration: 0-4, page: 页码, format: m3u8 (默认), json
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	query := r.URL.Query()
+	keyword := strings.TrimSpace(query.Get("q"))
+	if keyword == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty q")
+		return
+	}
+
+	order := query.Get("order")
+	switch order {
+	case "":
+		order = "totalrank"
+	case "totalrank", "click", "pubdate", "dm", "stow", "scores":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown order: %s", order)
+		return
+	}
+
+	duration := query.Get("duration")
+	switch duration {
+	case "":
+		duration = "0"
+	case "0", "1", "2", "3", "4":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid duration: %s", duration)
+		return
+	}
+
+	page, _ := strconv.Atoi(query.Get("page"))
+	page = max(page, 1)
+
+	log.Info().
+		Str("q", keyword).
+		Str("order", order).
+		Str("duration", duration).
+		Int("page", page).
+		Msg("Search request")
+
+	videos, err := fetchSearchVideos(keyword, order, duration, page)
+	if err != nil {
+		writeAPIError(w, err, "Failed to search videos")
+		return
+	}
+
+	baseUrl := requestBaseUrl(r)
+	items := make([]M3u8Item, len(videos))
+	for i, v := range videos {
+		items[i] = M3u8Item{
+			Duration:    parseLength(v.Duration),
+			Title:       v.Title,
+			Cover:       imageProxyUrl(baseUrl, v.Pic, 0, 0),
+			URL:         fmt.Sprintf("%s/v1/video/%s", baseUrl, v.Bvid),
+			Group:       v.Author,
+			Owner:       v.Author,
+			Bvid:        v.Bvid,
+			PubDate:     v.PubDate,
+			Description: v.Description,
+		}
+	}
+	data := M3u8Data{
+		Title: "搜索: " + keyword,
+		Items: items,
+	}
+	if wantJSON(r) {
+		writeJSON(w, data)
+		return
+	}
+	writeM3U8(w, "search", data)
+}
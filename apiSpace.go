@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 用户投稿视频, 需要 wbi 签名
+//
+//	.WithQuerys("mid", mid, "pn", pn, "ps", "30", "order", "pubdate")
+const URL_SPACE_ARC_SEARCH_WBI = `https://api.bilibili.com/x/space/wbi/arc/search`
+
+const (
+	SPACE_PAGE_SIZE = 30
+	// 单次请求最多返回的数量, 避免无上限地翻页请求
+	SPACE_MAX_LIMIT = 200
+)
+
+type spaceVideo struct {
+	Aid         int    `json:"aid"`
+	Bvid        string `json:"bvid"`
+	Title       string `json:"title"`
+	Pic         string `json:"pic"`
+	Description string `json:"description"`
+	Length      string `json:"length"`  // "mm:ss"
+	Created     int    `json:"created"` // 发布时间
+	Author      string `json:"author"`
+}
+
+// fetchSpaceVideos 获取用户投稿的第 pn 页 (按发布时间倒序), 优先从缓存获取
+func fetchSpaceVideos(mid string, pn int) ([]spaceVideo, error) {
+	key := fmt.Sprintf("space/%s/%d", mid, pn)
+	if videos, ok := getCached[[]spaceVideo](playlistCache, key); ok {
+		return videos, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_SPACE_ARC_SEARCH_WBI).WbiSign().
+		WithQuerys(
+			"mid", mid, "pn", strconv.Itoa(pn), "ps", strconv.Itoa(SPACE_PAGE_SIZE), "order", "pubdate",
+			// 缺少时容易触发风控 (-352)
+			"dm_img_list", "[]",
+			"dm_img_str", "V2ViR0wgMS4wIChPcGVuR0wgRVMgMi4wIENocm9taXVtKQ",
+			"dm_cover_img_str", "QU5HTEUgKEludGVsLCBJbnRlbChSKSBVSEQgR3JhcGhpY3MgNjMwICgweDAwMDAzRTlCKSBEaXJlY3QzRDExIHZzXzVfMCBwc181XzApR29vZ2xlIEluYy4gKEludGVsKQ",
+		)}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var videos []spaceVideo
+	err = req.ParseTo(&videos, "data", "list", "vlist")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return nil, err
+	}
+
+	setCached(playlistCache, key, videos, 10*time.Minute)
+	return videos, nil
+}
+
+// apiSpace UP 主投稿列表,
+// page: 起始页, limit: 最多返回数量 (不超过 200), since: 只返回该时间之后发布的视频,
+// format: m3u8 (默认), rss, atom, json
+func apiSpace(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	mid := r.PathValue("mid")
+	if _, err := strconv.Atoi(mid); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid mid: %s", mid)
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	page, _ := strconv.Atoi(query.Get("page"))
+	page = max(page, 1)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = SPACE_PAGE_SIZE
+	}
+	limit = min(limit, SPACE_MAX_LIMIT)
+	maxPages := (limit + SPACE_PAGE_SIZE - 1) / SPACE_PAGE_SIZE
+	since, err := parseSince(query.Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	log.Info().
+		Str("mid", mid).
+		Int("page", page).
+		Int("limit", limit).
+		Int("since", since).
+		Str("format", format).
+		Msg("Space request")
+
+	var videos []spaceVideo
+PAGING:
+	for pn := page; len(videos) < limit && pn < page+maxPages; pn++ {
+		pageVideos, err := fetchSpaceVideos(mid, pn)
+		if err != nil {
+			writeAPIError(w, err, "Failed to fetch space videos")
+			return
+		}
+		for _, v := range pageVideos {
+			if v.Created < since {
+				break PAGING // 按发布时间倒序, 之后的都更早
+			}
+			videos = append(videos, v)
+			if len(videos) >= limit {
+				break PAGING
+			}
+		}
+		if len(pageVideos) < SPACE_PAGE_SIZE {
+			break
+		}
+	}
+
+	author := mid
+	if len(videos) > 0 && videos[0].Author != "" {
+		author = videos[0].Author
+	}
+	baseUrl := requestBaseUrl(r)
+
+	switch format {
+	case "", "m3u8", "json":
+		items := make([]M3u8Item, len(videos))
+		for i, v := range videos {
+			items[i] = M3u8Item{
+				Duration:    parseLength(v.Length),
+				Title:       v.Title,
+				Cover:       imageProxyUrl(baseUrl, v.Pic, 0, 0),
+				URL:         fmt.Sprintf("%s/v1/video/%s", baseUrl, v.Bvid),
+				Group:       author,
+				Owner:       author,
+				Bvid:        v.Bvid,
+				PubDate:     v.Created,
+				Description: v.Description,
+			}
+		}
+		data := M3u8Data{
+			Title: author,
+			Items: items,
+		}
+		if format == "json" {
+			writeJSON(w, data)
+			return
+		}
+		writeM3U8(w, "space_"+mid, data)
+
+	case "rss", "atom":
+		enclosure := query.Get("enclosure")
+		feed := FeedData{
+			Title:       author + " 的投稿视频",
+			Link:        "https://space.bilibili.com/" + mid,
+			Description: author + " 的投稿视频",
+			Author:      author,
+			Updated:     int(time.Now().Unix()),
+			Items:       make([]FeedItem, len(videos)),
+		}
+		if len(videos) > 0 {
+			feed.Updated = videos[0].Created
+		}
+		for i, v := range videos {
+			item := FeedItem{
+				Title:       v.Title,
+				Link:        "https://www.bilibili.com/video/" + v.Bvid,
+				Guid:        v.Bvid,
+				Description: v.Description,
+				PubDate:     v.Created,
+				Duration:    parseLength(v.Length),
+				Image:       imageProxyUrl(baseUrl, v.Pic, 0, 0),
+			}
+			item.EnclosureURL, item.EnclosureType = feedEnclosure(baseUrl, v.Bvid, enclosure)
+			feed.Items[i] = item
+		}
+
+		if format == "rss" {
+			w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+			err = RssTemplate.Execute(w, feed)
+		} else {
+			w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+			err = AtomTemplate.Execute(w, feed)
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("format", format).
+				Msg("Failed to execute feed template")
+		}
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown format: %s", format)
+	}
+}
+
+// feedEnclosure 订阅中每项的媒体地址,
+// enclosure: m3u8 (默认), mpd, audio
+func feedEnclosure(baseUrl, bvid, enclosure string) (url, mimeType string) {
+	switch enclosure {
+	case "audio":
+		return fmt.Sprintf("%s/v1/audio/%s", baseUrl, bvid), "audio/mp4"
+	case "mpd":
+		return fmt.Sprintf("%s/v1/video/%s?p=all", baseUrl, bvid), "application/dash+xml"
+	default:
+		return fmt.Sprintf("%s/v1/video/%s", baseUrl, bvid), "application/vnd.apple.mpegurl"
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 视频快照 (进度条预览雪碧图)
+//
+//	.WithQuerys("aid", aid, "cid", cid, "index", "1")
+const URL_VIDEOSHOT = `https://api.bilibili.com/x/player/videoshot`
+
+type videoshot struct {
+	ImgXLen  int      `json:"img_x_len"`  // 每张雪碧图的列数
+	ImgYLen  int      `json:"img_y_len"`  // 每张雪碧图的行数
+	ImgXSize int      `json:"img_x_size"` // 单张缩略图宽度
+	ImgYSize int      `json:"img_y_size"` // 单张缩略图高度
+	Image    []string `json:"image"`      // 雪碧图 url, 无 scheme
+	Index    []int    `json:"index"`      // 每张缩略图对应的视频时间(s)
+}
+
+// fetchVideoshot 获取分P的雪碧图信息, 优先从缓存获取
+func fetchVideoshot(aid, cid int) (*videoshot, error) {
+	key := fmt.Sprintf("%d/%d", aid, cid)
+	if vs, ok := getCached[*videoshot](videoshotCache, key); ok {
+		return vs, nil
+	}
+
+	req := biligo.Chain{Req: biligo.NewGet(URL_VIDEOSHOT).
+		WithQuerys("aid", strconv.Itoa(aid), "cid", strconv.Itoa(cid), "index", "1")}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	vs := &videoshot{}
+	err = req.ParseTo(vs, "data")
+	if err != nil {
+		return nil, err
+	}
+	if len(vs.Image) == 0 || vs.ImgXLen == 0 || vs.ImgYLen == 0 {
+		return nil, fmt.Errorf("no videoshot available")
+	}
+
+	// index 首项为占位的 0
+	if len(vs.Index) > 1 && vs.Index[0] == 0 && vs.Index[1] == 0 {
+		vs.Index = vs.Index[1:]
+	}
+	// 最后一张雪碧图可能没有填满
+	if tiles := len(vs.Image) * vs.ImgXLen * vs.ImgYLen; len(vs.Index) > tiles {
+		vs.Index = vs.Index[:tiles]
+	}
+
+	setCached(videoshotCache, key, vs, 30*time.Minute)
+	return vs, nil
+}
+
+// thumbnailData 按 DASH-IF 缩略图约定均分每张缩略图的时长
+func (vs *videoshot) thumbnailData(duration int) *ThumbnailData {
+	if len(vs.Index) == 0 || duration <= 0 {
+		return nil
+	}
+	return &ThumbnailData{
+		Cols:          vs.ImgXLen,
+		Rows:          vs.ImgYLen,
+		TileWidth:     vs.ImgXSize,
+		TileHeight:    vs.ImgYSize,
+		SheetDuration: duration * 1000 * vs.ImgXLen * vs.ImgYLen / len(vs.Index),
+	}
+}
+
+// resolvePageNum 解析 query p, 默认为 1
+func resolvePageNum(p string, vInfo *biligo.VideoInfo) (int, error) {
+	if p == "" {
+		return 1, nil
+	}
+	pageNum, err := strconv.Atoi(p)
+	if err != nil || pageNum < 1 || pageNum > len(vInfo.Pages) {
+		return 0, fmt.Errorf("invalid page num: %s", p)
+	}
+	return pageNum, nil
+}
+
+// apiThumbnails 返回带 #xywh= 雪碧图坐标的 WebVTT 缩略图轨道
+func apiThumbnails(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	p := r.URL.Query().Get("p")
+	log.Info().
+		Str("id", id).
+		Str("p", p).
+		Msg("Thumbnails request")
+
+	vInfo, pageNum, vs, ok := thumbnailsLookup(w, id, p)
+	if !ok {
+		return
+	}
+	page := vInfo.Pages[pageNum-1]
+
+	// Host 与 id 来自客户端, 不能作为格式化字符串
+	spriteBase := requestBaseUrl(r) + "/v1/thumbnails/" + netUrl.PathEscape(id) + "/"
+	spriteQuery := "?p=" + strconv.Itoa(pageNum)
+	tilesPerSheet := vs.ImgXLen * vs.ImgYLen
+
+	cues := make([]VttCue, 0, len(vs.Index))
+	for i, start := range vs.Index {
+		end := page.Duration
+		if i+1 < len(vs.Index) {
+			end = vs.Index[i+1]
+		}
+		if end <= start {
+			continue
+		}
+
+		tile := i % tilesPerSheet
+		cues = append(cues, VttCue{
+			Start: start * 1000,
+			End:   end * 1000,
+			Text: spriteBase + strconv.Itoa(i/tilesPerSheet+1) + spriteQuery +
+				fmt.Sprintf("#xywh=%d,%d,%d,%d",
+					tile%vs.ImgXLen*vs.ImgXSize, tile/vs.ImgXLen*vs.ImgYSize,
+					vs.ImgXSize, vs.ImgYSize),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	err := VttTemplate.Execute(w, VttData{Cues: cues})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to execute VTT template")
+	}
+}
+
+// apiThumbnailSprite 代理第 n 张雪碧图 (从 1 开始)
+func apiThumbnailSprite(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	n, err := strconv.Atoi(strings.TrimSuffix(r.PathValue("n"), ".jpg"))
+
+	_, _, vs, ok := thumbnailsLookup(w, id, r.URL.Query().Get("p"))
+	if !ok {
+		return
+	}
+	if err != nil || n < 1 || n > len(vs.Image) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Sprite %s not found", r.PathValue("n"))
+		return
+	}
+
+	url := vs.Image[n-1]
+	if strings.HasPrefix(url, "//") {
+		url = "https:" + url
+	}
+	proxyUpstream(w, r, url)
+}
+
+// thumbnailsLookup 获取视频信息与雪碧图, 失败时写入响应
+func thumbnailsLookup(w http.ResponseWriter, id, p string) (vInfo *biligo.VideoInfo, pageNum int, vs *videoshot, ok bool) {
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty id")
+		return
+	}
+	if !checkBackoff(w) {
+		return
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
+	}
+
+	pageNum, err = resolvePageNum(p, vInfo)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	vs, err = fetchVideoshot(vInfo.Aid, vInfo.Pages[pageNum-1].Cid)
+	if isBiliError(err) {
+		writeAPIError(w, err, "Failed to fetch videoshot")
+		return
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to fetch videoshot")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Failed to fetch videoshot: %v", err)
+		return
+	}
+
+	return vInfo, pageNum, vs, true
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/Miuzarte/BiliProxyM3U8/templates"
 
@@ -18,41 +21,96 @@ func apiVideo(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Empty id")
 		return
 	}
+	if !checkBackoff(w) {
+		return
+	}
+
+	query := r.URL.Query()
+
+	// 音频区的歌曲只有音频流
+	if strings.HasPrefix(id, "au") {
+		location := "/v1/audio/" + id
+		if r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, location, http.StatusFound)
+		return
+	}
+	// 番剧的 ep/ss/md 号先解析为 av 号
+	switch {
+	case strings.HasPrefix(id, "ep"), strings.HasPrefix(id, "ss"), strings.HasPrefix(id, "md"):
+		if !checkBackoff(w) {
+			return
+		}
+		link, err := resolveLink(id)
+		if isBiliError(err) {
+			writeAPIError(w, err, "Failed to resolve bangumi")
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		http.Redirect(w, r, link.location(query), http.StatusFound)
+		return
+	}
 
-	p := r.URL.Query().Get("p")
+	p := query.Get("p")
 
-	if p != "" {
+	switch {
+	case p != "":
 		generateMPD(w, r, id, p)
-	} else {
+	case query.Get("collection") == "1":
+		generateCollectionM3U8(w, r, id)
+	default:
 		generateM3U8(w, r, id)
 	}
 }
 
-func generateM3U8(w http.ResponseWriter, r *http.Request, id string) {
-	log.Info().
-		Str("id", id).
-		Str("user-agent", r.Header.Get("User-Agent")).
-		Msg("M3U8 playlist request")
-
-	var vInfo *biligo.VideoInfo
+// getVideoInfo 优先从缓存获取视频信息
+func getVideoInfo(id string) (*biligo.VideoInfo, error) {
 	vInfo, cached := getCachedVideoInfo(id)
-	if !cached {
-		var err error
-		info, err := biligo.FetchVideoInfo(id)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Msg("Failed to fetch video info")
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Failed to fetch video info: %v", err)
-			return
-		}
-		vInfo = &info
-		setCachedVideoInfo(id, vInfo)
+	if cached {
+		log.Debug().Str("id", id).Msg("Video info from cache")
+		return vInfo, nil
 	}
 
-	pages := vInfo.Pages
+	aid, err := biligo.AnyToAid(id)
+	if err != nil {
+		return nil, err
+	}
+	req := biligo.Chain{Req: biligo.ReqVideoInfo(aid)}
+	err = doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	info, err := req.ToVideoInfo()
+	if err != nil {
+		return nil, err
+	}
+	vInfo = &info
+	setCachedVideoInfo(id, vInfo)
+	log.Debug().Str("id", id).Msg("Video info cached")
+	return vInfo, nil
+}
+
+// audioOnly query audio=only 时只输出音频流
+func audioOnly(r *http.Request) bool {
+	return r.URL.Query().Get("audio") == "only"
+}
+
+// startTime query t, 开始播放的位置(s), 允许小数
+func startTime(r *http.Request) int {
+	t, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || t <= 0 {
+		return 0
+	}
+	return int(t)
+}
 
+// requestBaseUrl 推断客户端访问本服务所用的 scheme://host
+func requestBaseUrl(r *http.Request) string {
 	host := r.Host
 	if host == "" {
 		host = server.Addr
@@ -66,184 +124,474 @@ func generateM3U8(w http.ResponseWriter, r *http.Request, id string) {
 	if r.TLS != nil {
 		scheme = "https"
 	}
+	return scheme + "://" + host
+}
+
+// parsePageRange 解析 query p,
+// 支持 "3", "2-5", "3-" (到最后一P), "all",
+// 返回从 1 开始的闭区间
+func parsePageRange(p string, total int) (from, to int, err error) {
+	p = strings.TrimSpace(strings.ToLower(p))
+	if p == "all" {
+		return 1, total, nil
+	}
+
+	start, end, isRange := strings.Cut(p, "-")
+	from, err = strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid page num %q", start)
+	}
+	to = from
+	if isRange {
+		if end == "" {
+			to = total
+		} else {
+			to, err = strconv.Atoi(end)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid page num %q", end)
+			}
+		}
+	}
+
+	if from < 1 || to < from {
+		return 0, 0, fmt.Errorf("invalid page range %d-%d", from, to)
+	}
+	if to > total {
+		return 0, 0, fmt.Errorf("page num %d out of range %d", to, total)
+	}
+	return from, to, nil
+}
 
-	var items []M3u8Item
-	maxDuration := 0
-	for i, page := range pages {
+// pageTitle 多P视频时附加分P标题
+func pageTitle(vInfo *biligo.VideoInfo, pageNum int) string {
+	page := vInfo.Pages[pageNum-1]
+	if len(vInfo.Pages) > 1 && page.Part != "" {
+		return fmt.Sprintf("%s - %s", vInfo.Title, page.Part)
+	}
+	return vInfo.Title
+}
+
+// videoM3u8Items 将视频的每个分P生成为播放列表项
+func videoM3u8Items(baseUrl, id string, vInfo *biligo.VideoInfo) []M3u8Item {
+	items := make([]M3u8Item, 0, len(vInfo.Pages))
+	for i, page := range vInfo.Pages {
 		partTitle := page.Part
 		if partTitle == "" {
 			partTitle = fmt.Sprintf("P%d", i+1)
 		}
 
-		if page.Duration > maxDuration {
-			maxDuration = page.Duration
+		cover := page.FirstFrame
+		if cover == "" {
+			cover = vInfo.Pic
 		}
 
 		items = append(items, M3u8Item{
-			Duration: page.Duration,
-			Title:    partTitle,
-			URL:      fmt.Sprintf("%s://%s/v1/video/%s?p=%d", scheme, host, id, i+1),
+			Duration:    page.Duration,
+			Title:       partTitle,
+			Cover:       imageProxyUrl(baseUrl, cover, 0, 0),
+			URL:         fmt.Sprintf("%s/v1/video/%s?p=%d", baseUrl, id, i+1),
+			Group:       vInfo.Title,
+			Owner:       vInfo.Owner.Name,
+			Bvid:        vInfo.Bvid,
+			Page:        i + 1,
+			Cid:         page.Cid,
+			PubDate:     vInfo.PubDate,
+			Description: vInfo.Desc,
 		})
 	}
-
-	data := M3u8Data{
-		Title:       vInfo.Title,
-		MaxDuration: maxDuration,
-		Items:       items,
-	}
-
-	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.m3u8\"", id))
-
-	err := M3u8Template.Execute(w, data)
-	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Failed to execute M3U8 template")
-		w.WriteHeader(http.StatusInternalServerError)
-	}
+	return items
 }
 
-func generateMPD(w http.ResponseWriter, r *http.Request, id, p string) {
+func generateM3U8(w http.ResponseWriter, r *http.Request, id string) {
 	log.Info().
 		Str("id", id).
-		Str("p", p).
 		Str("user-agent", r.Header.Get("User-Agent")).
-		Msg("MPD request")
+		Msg("M3U8 playlist request")
 
-	pageNum := 1
-	if p != "" {
-		var err error
-		pageNum, err = strconv.Atoi(p)
-		if err != nil || pageNum < 1 {
-			log.Error().
-				Err(err).
-				Int("pageNum", pageNum).
-				Msg("Invalid page num")
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Invalid page num: %d", pageNum)
-			return
-		}
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
 	}
 
-	var vInfo *biligo.VideoInfo
-	vInfo, cached := getCachedVideoInfo(id)
-	if !cached {
-		var err error
-		info, err := biligo.FetchVideoInfo(id)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Msg("Failed to fetch video info")
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Failed to fetch video info: %v", err)
-			return
+	baseUrl := requestBaseUrl(r)
+	items := videoM3u8Items(baseUrl, id, vInfo)
+	if audioOnly(r) {
+		for i := range items {
+			items[i].URL = appendQuery(items[i].URL, "audio", "only")
+		}
+	}
+	// 显式指定的账号需要带到每一项, 按规则选择的账号由客户端自身决定
+	if account := r.URL.Query().Get("account"); account != "" {
+		for i := range items {
+			items[i].URL = appendQuery(items[i].URL, "account", account)
 		}
-		vInfo = &info
-		setCachedVideoInfo(id, vInfo)
-		log.Debug().Str("id", id).Msg("Video info cached")
-	} else {
-		log.Debug().Str("id", id).Msg("Video info from cache")
 	}
 
-	pages := vInfo.Pages
+	// 章节需要逐P请求接口, 只在指定时附带
+	if r.URL.Query().Get("chapters") == "1" {
+		attachChapters(vInfo, items)
+	}
 
-	if pageNum > len(pages) {
-		log.Warn().
-			Int("pageNum", pageNum).
-			Int("len(pages)", len(pages)).
-			Msg("Page num out of range")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Page num %d out of range %d", pageNum, len(pages))
-		return
+	// 不指定分P时 t 对应 P1
+	start := startTime(r)
+	if start > 0 && len(items) > 0 && start < items[0].Duration {
+		items[0].Start = start
+		items[0].URL = appendQuery(items[0].URL, "t", strconv.Itoa(start))
+	} else {
+		start = 0
+		if resumeRequested(r) {
+			start = resumeM3u8Items(r, vInfo, items)
+		}
 	}
 
-	page := vInfo.Pages[pageNum-1]
+	writeM3U8(w, id, M3u8Data{
+		Title: vInfo.Title,
+		Cover: imageProxyUrl(baseUrl, vInfo.Pic, 0, 0),
+		Start: start,
+		Items: items,
+	})
+}
 
-	playurls, err := biligo.FetchVideoPlayurl(id, strconv.Itoa(page.Cid), biligo.VIDED_FNVAL_DASHALL)
+// generateCollectionM3U8 展开为视频所属的整个合集,
+// 不属于合集时退化为普通播放列表
+func generateCollectionM3U8(w http.ResponseWriter, r *http.Request, id string) {
+	vInfo, err := getVideoInfo(id)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Failed to fetch video playurl")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "Failed to fetch video playurl: %v", err)
+		writeAPIError(w, err, "Failed to fetch video info")
 		return
 	}
-	dash := playurls.Dash
-	if dash == nil {
-		log.Error().
-			Msg("Failed to get dash info")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Failed to get dash info")
+
+	seasonId, err := fetchVideoSeason(vInfo.Aid)
+	if err != nil || seasonId == 0 {
+		log.Warn().
+			Err(err).
+			Str("id", id).
+			Msg("Video not in a collection")
+		generateM3U8(w, r, id)
 		return
 	}
 
-	var selectedStream biligo.VideoPlayurlDashInfo
+	seasonIdStr := strconv.Itoa(seasonId)
+	list, err := fetchSeason(strconv.Itoa(vInfo.Owner.Mid), seasonIdStr)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch collection")
+		return
+	}
+	writeArchiveList(w, r, "collection_"+seasonIdStr, list)
+}
 
+// selectDashStreams 按编码优先级与最高画质选择视频流, 音频取第一条
+func selectDashStreams(dash *biligo.DideoPlayurlDash) (video, audio biligo.VideoPlayurlDashInfo) {
 LOOP:
 	for _, codecId := range codecPriority {
 		bestQuality := -1
 		for _, v := range dash.Video {
 			if v.Codecid == codecId && v.Id <= maxQuality {
 				if v.Id > bestQuality {
-					selectedStream = v
+					video = v
 					break LOOP
 				}
 			}
 		}
 	}
 
-	if selectedStream.Id == 0 {
-		selectedStream = dash.Video[0]
+	if video.Id == 0 {
+		video = dash.Video[0]
 		log.Warn().
 			Int("maxQuality", maxQuality).
-			Int("available", selectedStream.Id).
+			Int("available", video.Id).
 			Msg("No video <= maxQuality found, using first available")
 	}
 
-	videoUrl := selectedStream.BackupUrl[0] // avoid pcdn
-	selectedAudio := dash.Audio[0]
-	audioUrl := selectedAudio.BackupUrl[0]
+	return video, dash.Audio[0]
+}
+
+// fetchPlayurl 以 account 获取 cid 的播放地址, 保证有 dash 流,
+// account 为空时使用默认账号
+func fetchPlayurl(aid, cid int, account string) (*biligo.VideoPlayurl, error) {
+	key := strconv.Itoa(cid) + accountSuffix(account)
+	if playurl, ok := getCached[*biligo.VideoPlayurl](playurlCache, key); ok {
+		return playurl, nil
+	}
+
+	fetch := func() (biligo.VideoPlayurl, error) {
+		if account == "" {
+			req := biligo.Chain{Req: biligo.ReqVideoPlayurl(
+				"avid", strconv.Itoa(aid), "cid", strconv.Itoa(cid),
+				"fnval", strconv.Itoa(int(biligo.VIDED_FNVAL_DASHALL)),
+				"fourk", "1", "try_look", "1",
+			)}
+			err := doChain(&req)
+			if err != nil {
+				return biligo.VideoPlayurl{}, err
+			}
+			return req.ToVideoPlayurl()
+		}
+		return fetchPlayurlAs(account, aid, cid)
+	}
+	playurls, err := fetch()
+	// -352 也可能是 wbi key 过期导致的签名错误, 更新后重试一次
+	if kind, _ := classifyError(err); err != nil && kind == ERR_RISK_CONTROL {
+		log.Warn().
+			Err(err).
+			Int("cid", cid).
+			Msg("Risk control on playurl, retrying with updated wbi keys")
+		if biligo.WbiUpdate() == nil {
+			playurls, err = fetch()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch video playurl: %w", err)
+	}
+	dash := playurls.Dash
+	if dash == nil || len(dash.Video) == 0 || len(dash.Audio) == 0 {
+		return nil, fmt.Errorf("failed to get dash info")
+	}
+	setCached(playurlCache, key, &playurls, PLAYURL_CACHE_TTL)
+	return &playurls, nil
+}
+
+// buildPeriod 获取指定分P的 dash 流并生成 MPD Period
+func buildPeriod(vInfo *biligo.VideoInfo, pageNum int, account string) (PeriodData, error) {
+	page := vInfo.Pages[pageNum-1]
+
+	period, err := buildCidPeriod(vInfo.Aid, page.Cid, page.Duration, account)
+	if err != nil {
+		return PeriodData{}, err
+	}
+
+	var thumbnails *ThumbnailData
+	vs, err := fetchVideoshot(vInfo.Aid, page.Cid)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("page", pageNum).
+			Msg("Failed to fetch videoshot")
+	} else {
+		thumbnails = vs.thumbnailData(page.Duration)
+	}
+
+	period.Title = pageTitle(vInfo, pageNum)
+	period.Page = pageNum
+	period.Thumbnails = thumbnails
+	return period, nil
+}
+
+// buildCidPeriod 获取 cid 的 dash 流并生成 MPD Period,
+// duration <= 0 时取 dash 中的时长
+func buildCidPeriod(aid, cid, duration int, account string) (PeriodData, error) {
+	playurl, err := fetchPlayurl(aid, cid, account)
+	if err != nil {
+		return PeriodData{}, err
+	}
+	dash := playurl.Dash
+	if duration <= 0 {
+		duration = dash.Duration
+	}
+
+	selectedStream, selectedAudio := selectDashStreams(dash)
 
 	log.Info().
+		Int("cid", cid).
+		Str("account", account).
 		Int("codecid", selectedStream.Codecid).
 		Int("quality", selectedStream.Id).
 		Str("codecs", selectedStream.Codecs).
 		Msg("Selected video stream")
 
+	limited := qualityLimitReason(playurl.AcceptQuality, dash, account)
+	if limited != "" {
+		log.Warn().
+			Int("cid", cid).
+			Int("maxQuality", maxQuality).
+			Ints("acceptQuality", playurl.AcceptQuality).
+			Str("reason", limited).
+			Msg("Requested quality is unavailable")
+	}
+
+	// 心跳使用默认账号, 其他账号的播放不上报
+	if account == "" {
+		registerStream(selectedStream.BackupUrl[0], aid, cid, selectedStream.SegmentBase.IndexRange)
+		registerStream(selectedAudio.BackupUrl[0], aid, cid, selectedAudio.SegmentBase.IndexRange)
+	}
+
+	// 章节只是附加信息, 获取失败不影响播放
+	chapters, err := fetchChapters(aid, cid)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("cid", cid).
+			Msg("Failed to fetch chapters")
+	}
+
+	return PeriodData{
+		Cid:             cid,
+		Duration:        duration,
+		VideoURL:        selectedStream.BackupUrl[0], // avoid pcdn
+		VideoMimeType:   selectedStream.MimeType,
+		VideoCodecs:     selectedStream.Codecs,
+		VideoBandwidth:  selectedStream.Bandwidth,
+		VideoWidth:      selectedStream.Width,
+		VideoHeight:     selectedStream.Height,
+		VideoFrameRate:  selectedStream.FrameRate,
+		VideoInitRange:  selectedStream.SegmentBase.Initialization,
+		VideoIndexRange: selectedStream.SegmentBase.IndexRange,
+		AudioURL:        selectedAudio.BackupUrl[0],
+		AudioMimeType:   selectedAudio.MimeType,
+		AudioCodecs:     selectedAudio.Codecs,
+		AudioBandwidth:  selectedAudio.Bandwidth,
+		AudioInitRange:  selectedAudio.SegmentBase.Initialization,
+		AudioIndexRange: selectedAudio.SegmentBase.IndexRange,
+		Chapters:        chapters,
+		QualityLimited:  limited,
+	}, nil
+}
+
+const (
+	// 单个 MPD 最多合并的分P数, 超过时截断, 避免一次嗅探请求上百次接口
+	MPD_MAX_PAGES = 50
+	// 同时获取的分P数
+	MPD_FETCH_CONCURRENCY = 4
+	// 流地址约 2 小时后失效, 缓存远短于此
+	PLAYURL_CACHE_TTL = 10 * time.Minute
+)
+
+func generateMPD(w http.ResponseWriter, r *http.Request, id, p string) {
+	log.Info().
+		Str("id", id).
+		Str("p", p).
+		Str("user-agent", r.Header.Get("User-Agent")).
+		Msg("MPD request")
+
+	account, err := requestAccount(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
+	}
+
+	from, to, err := parsePageRange(p, len(vInfo.Pages))
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("p", p).
+			Int("len(pages)", len(vInfo.Pages)).
+			Msg("Invalid page range")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid page range: %v", err)
+		return
+	}
+
+	if to-from+1 > MPD_MAX_PAGES {
+		log.Warn().
+			Int("from", from).
+			Int("to", to).
+			Int("max", MPD_MAX_PAGES).
+			Msg("Too many pages in one MPD, truncated")
+		to = from + MPD_MAX_PAGES - 1
+	}
+
+	// 先于 registerStream, 使最后一P的流被跟踪播放位置
+	if threshold, ok := parseWatchLaterThreshold(r.URL.Query().Get("watchlater")); ok {
+		// 只跟踪默认账号的播放, 删除也以默认账号进行
+		if account != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "watchlater is only supported with the default account, got %q", account)
+			return
+		}
+		last := vInfo.Pages[to-1]
+		armWatchLaterRemoval(vInfo.Aid, last.Cid, last.Duration, threshold)
+	}
+
+	periods := make([]PeriodData, to-from+1)
+	errs := make([]error, len(periods))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MPD_FETCH_CONCURRENCY)
+	for i := range periods {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			periods[i], errs[i] = buildPeriod(vInfo, from+i, account)
+		})
+	}
+	wg.Wait()
+
+	totalDuration := 0
+	for i := range periods {
+		if errs[i] != nil {
+			writeAPIError(w, errs[i], fmt.Sprintf("Failed to build period P%d", from+i))
+			return
+		}
+		periods[i].Start = totalDuration
+		totalDuration += periods[i].Duration
+	}
+
 	title := vInfo.Title
-	if len(vInfo.Pages) > 1 && page.Part != "" {
-		title = fmt.Sprintf("%s - %s", vInfo.Title, page.Part)
+	if from == to {
+		title = periods[0].Title
+	}
+
+	// t 为整个 MPD 中的时间
+	start := startTime(r)
+	if start <= 0 && resumeRequested(r) {
+		start = resumeStart(vInfo, account, periods)
+	}
+	if start > 0 {
+		periods, totalDuration = startPeriods(periods, start)
 	}
 
 	data := MpdData{
 		Title:         title,
+		CoverURL:      imageProxyUrl(requestBaseUrl(r), vInfo.Pic, 0, 0),
 		OwnerName:     vInfo.Owner.Name,
 		Aid:           vInfo.Aid,
 		Bvid:          vInfo.Bvid,
-		TotalDuration: page.Duration,
-		Periods: []PeriodData{{
-			Duration:        page.Duration,
-			VideoURL:        videoUrl,
-			VideoMimeType:   selectedStream.MimeType,
-			VideoCodecs:     selectedStream.Codecs,
-			VideoBandwidth:  selectedStream.Bandwidth,
-			VideoWidth:      selectedStream.Width,
-			VideoHeight:     selectedStream.Height,
-			VideoFrameRate:  selectedStream.FrameRate,
-			VideoInitRange:  selectedStream.SegmentBase.Initialization,
-			VideoIndexRange: selectedStream.SegmentBase.IndexRange,
-			AudioURL:        audioUrl,
-			AudioMimeType:   selectedAudio.MimeType,
-			AudioCodecs:     selectedAudio.Codecs,
-			AudioBandwidth:  selectedAudio.Bandwidth,
-			AudioInitRange:  selectedAudio.SegmentBase.Initialization,
-			AudioIndexRange: selectedAudio.SegmentBase.IndexRange,
-		}},
+		TotalDuration: totalDuration,
+		AudioOnly:     audioOnly(r),
+		Periods:       periods,
+	}
+
+	writeMPD(w, data)
+}
+
+// startPeriods 使 MPD 从 start(s) 处开始播放:
+// 静态 MPD 没有通用的起播位置, 只能去掉之前的 Period,
+// 所在的 Period 以 presentationTimeOffset 跳过开头, 返回新的总时长
+func startPeriods(periods []PeriodData, start int) ([]PeriodData, int) {
+	for i := range periods {
+		if start < periods[i].Start+periods[i].Duration {
+			periods = periods[i:]
+			periods[0].StartOffset = start - periods[0].Start
+			periods[0].Duration -= periods[0].StartOffset
+			break
+		}
+	}
+
+	totalDuration := 0
+	for i := range periods {
+		periods[i].Start = totalDuration
+		totalDuration += periods[i].Duration
 	}
+	return periods, totalDuration
+}
 
+// writeMPD 输出 MPD, 画质受限时在 X-BProxy-Quality-Limited 中给出原因
+func writeMPD(w http.ResponseWriter, data MpdData) {
+	for _, period := range data.Periods {
+		if period.QualityLimited != "" {
+			w.Header().Set("X-BProxy-Quality-Limited", period.QualityLimited)
+			break
+		}
+	}
 	w.Header().Set("Content-Type", "application/dash+xml")
-	err = MpdTemplate.Execute(w, data)
+	err := MpdTemplate.Execute(w, data)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 稍后再看列表
+	URL_WATCH_LATER_LIST = `https://api.bilibili.com/x/v2/history/toview`
+	// 从稍后再看中删除, POST
+	//	aid=aid&csrf=bili_jct
+	URL_WATCH_LATER_DEL = `https://api.bilibili.com/x/v2/history/toview/del`
+)
+
+type watchLaterItem struct {
+	Aid      int    `json:"aid"`
+	Bvid     string `json:"bvid"`
+	Title    string `json:"title"`
+	Pic      string `json:"pic"`
+	Desc     string `json:"desc"`
+	Duration int    `json:"duration"`
+	PubDate  int    `json:"pubdate"`
+	Videos   int    `json:"videos"` // 分P数
+	Progress int    `json:"progress"`
+	Owner    struct {
+		Mid  int    `json:"mid"`
+		Name string `json:"name"`
+	} `json:"owner"`
+}
+
+func fetchWatchLater() ([]watchLaterItem, error) {
+	req := biligo.Chain{Req: biligo.NewGet(URL_WATCH_LATER_LIST)}
+	err := doChain(&req)
+	if err != nil {
+		return nil, err
+	}
+	var list []watchLaterItem
+	err = req.ParseTo(&list, "data", "list")
+	if err != nil && !biligo.UnwrapErr(err).Is(biligo.ErrChainPathNotExists) {
+		return nil, err
+	}
+	return list, nil
+}
+
+func removeWatchLater(aid int) error {
+	form := netUrl.Values{
+		"aid":  {strconv.Itoa(aid)},
+		"csrf": {csrfToken()},
+	}
+	req := biligo.Chain{Req: biligo.NewPost(URL_WATCH_LATER_DEL,
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))}
+	return doChain(&req)
+}
+
+// watchLaterWatch 等待分P的播放进度达到阈值
+type watchLaterWatch struct {
+	aid      int
+	target   int       // 需要播放到的位置(s)
+	activeAt time.Time // 最近一次播放活动
+}
+
+var (
+	// cid -> 待执行的删除
+	watchLaterPending   = map[int]*watchLaterWatch{}
+	watchLaterPendingMu sync.Mutex
+)
+
+// armWatchLaterRemoval 在该分P实际播放到其时长的 threshold 比例后,
+// 从稍后再看中删除, 重复请求不会重新计时
+func armWatchLaterRemoval(aid, cid, duration int, threshold float64) {
+	watchLaterPendingMu.Lock()
+	defer watchLaterPendingMu.Unlock()
+
+	if _, ok := watchLaterPending[cid]; ok {
+		return
+	}
+
+	target := int(float64(duration) * threshold)
+	log.Info().
+		Int("aid", aid).
+		Int("cid", cid).
+		Int("target", target).
+		Msg("Watch later removal armed")
+
+	watchLaterPending[cid] = &watchLaterWatch{
+		aid:      aid,
+		target:   target,
+		activeAt: time.Now(),
+	}
+}
+
+// watchLaterArmed 该分P是否在等待播放进度
+func watchLaterArmed(cid int) bool {
+	watchLaterPendingMu.Lock()
+	defer watchLaterPendingMu.Unlock()
+	_, ok := watchLaterPending[cid]
+	return ok
+}
+
+// checkWatchLaterProgress 播放进度达到阈值时删除,
+// 要求实际播放的时长不少于目标位置的 1/4 (允许倍速与少量跳转),
+// 避免一次拖动到结尾或播放器的嗅探请求触发删除
+func checkWatchLaterProgress(cid, position int, played time.Duration) {
+	watchLaterPendingMu.Lock()
+	defer watchLaterPendingMu.Unlock()
+
+	watch, ok := watchLaterPending[cid]
+	if !ok {
+		return
+	}
+	watch.activeAt = time.Now()
+	if position < watch.target || played < time.Duration(watch.target)*time.Second/4 {
+		return
+	}
+	delete(watchLaterPending, cid)
+
+	aid := watch.aid
+	cwg.Go(func(_ context.Context) {
+		err := removeWatchLater(aid)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("aid", aid).
+				Msg("Failed to remove from watch later")
+			return
+		}
+		log.Info().
+			Int("aid", aid).
+			Msg("Removed from watch later")
+	})
+}
+
+// expireWatchLater 取消长时间没有播放活动的删除
+func expireWatchLater() {
+	watchLaterPendingMu.Lock()
+	defer watchLaterPendingMu.Unlock()
+
+	for cid, watch := range watchLaterPending {
+		if time.Since(watch.activeAt) > PROGRESS_IDLE_TIMEOUT {
+			delete(watchLaterPending, cid)
+			log.Info().
+				Int("aid", watch.aid).
+				Int("cid", cid).
+				Msg("Watch later removal cancelled, no playback activity")
+		}
+	}
+}
+
+// parseWatchLaterThreshold 解析 query 中的删除阈值 (0, 1]
+func parseWatchLaterThreshold(s string) (float64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	threshold, err := strconv.ParseFloat(s, 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		return 0, false
+	}
+	return threshold, true
+}
+
+// apiWatchLater 稍后再看播放列表,
+// remove=0.9 时最后一P实际播放到 90% 后自动从稍后再看中删除
+func apiWatchLater(w http.ResponseWriter, r *http.Request) {
+	if !checkBackoff(w) {
+		return
+	}
+	if _, ok := requireLogin(w); !ok {
+		return
+	}
+	remove := r.URL.Query().Get("remove")
+	log.Info().
+		Str("remove", remove).
+		Msg("Watch later request")
+
+	_, removeEnabled := parseWatchLaterThreshold(remove)
+	// 具名账号的播放不被跟踪, 无法删除
+	if account, err := requestAccount(r); removeEnabled && (err != nil || account != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "remove is only supported with the default account")
+		return
+	}
+
+	list, err := fetchWatchLater()
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch watch later")
+		return
+	}
+
+	baseUrl := requestBaseUrl(r)
+
+	var items []M3u8Item
+	for _, v := range list {
+		videoItems := listVideoItems(baseUrl, v.Bvid, v.Videos, true, M3u8Item{
+			Duration:    v.Duration,
+			Title:       v.Title,
+			Cover:       imageProxyUrl(baseUrl, v.Pic, 0, 0),
+			Group:       "稍后再看",
+			Owner:       v.Owner.Name,
+			Bvid:        v.Bvid,
+			PubDate:     v.PubDate,
+			Description: v.Desc,
+		})
+		if removeEnabled {
+			last := &videoItems[len(videoItems)-1]
+			last.URL = appendQuery(last.URL, "watchlater", remove)
+		}
+		items = append(items, videoItems...)
+	}
+
+	data := M3u8Data{
+		Title: "稍后再看",
+		Items: items,
+	}
+	if wantJSON(r) {
+		writeJSON(w, data)
+		return
+	}
+	writeM3U8(w, "watchlater", data)
+}
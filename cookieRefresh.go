@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	netUrl "net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// 检查是否需要刷新 cookie, 未登录时 code 为 -101
+	//	.WithQuery("csrf", csrf)
+	URL_COOKIE_INFO = `https://passport.bilibili.com/x/passport-login/web/cookie/info`
+	// 获取 refresh_csrf, 返回 html
+	//	URL_CORRESPOND + correspondPath
+	URL_CORRESPOND = `https://www.bilibili.com/correspond/1/`
+	// 刷新 cookie, POST, 新 cookie 在 Set-Cookie 中
+	//	csrf, refresh_csrf, source=main_web, refresh_token
+	URL_COOKIE_REFRESH = `https://passport.bilibili.com/x/passport-login/web/cookie/refresh`
+	// 确认刷新, 使旧的 refresh_token 失效, POST
+	//	csrf (新), refresh_token (旧)
+	URL_CONFIRM_REFRESH = `https://passport.bilibili.com/x/passport-login/web/confirm/refresh`
+)
+
+const COOKIE_CHECK_INTERVAL = 12 * time.Hour
+
+// 用于生成 correspondPath 的公钥
+const CORRESPOND_PUBLIC_KEY = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDLgd2OAkcGVtoE3ThUREbio0Eg
+Uc/prcajMKXvkCKFCWhJYJcLkcM2DKKcSeFpD/j6Boy538YXnR6VhcuUJOhH2x71
+nzPjfdTcqMz7djHum0qSZA0AyCBDABUqCrfNgCiJ00Ra7GmRj+YCK1NJEuewlb40
+JNrRuoEUXpabUzGB8QIDAQAB
+-----END PUBLIC KEY-----`
+
+var refreshCsrfRegexp = regexp.MustCompile(`<div id="1-name">(\w+)</div>`)
+
+// errReloginRequired cookie 已失效, 只能重新登录
+var errReloginRequired = fmt.Errorf("cookie expired, re-login required")
+
+// checkCookieRefresh 检查 cookie 是否需要刷新, 返回服务器的毫秒时间戳
+func checkCookieRefresh() (refresh bool, timestamp int64, err error) {
+	req := biligo.Chain{Req: biligo.NewGet(URL_COOKIE_INFO).
+		WithQuery("csrf", csrfToken())}
+	err = req.Do()
+	if err != nil {
+		if biligo.UnwrapErr(err).Is(biligo.ErrChainRespCodeNotZero) {
+			return false, 0, errReloginRequired
+		}
+		return false, 0, err
+	}
+	var info struct {
+		Refresh   bool  `json:"refresh"`
+		Timestamp int64 `json:"timestamp"`
+	}
+	err = req.ParseTo(&info, "data")
+	if err != nil {
+		return false, 0, err
+	}
+	return info.Refresh, info.Timestamp, nil
+}
+
+// correspondPath 用公钥加密 "refresh_{timestamp}"
+func correspondPath(timestamp int64) (string, error) {
+	block, _ := pem.Decode([]byte(CORRESPOND_PUBLIC_KEY))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub.(*rsa.PublicKey),
+		[]byte("refresh_"+strconv.FormatInt(timestamp, 10)), nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(encrypted), nil
+}
+
+// fetchRefreshCsrf 从 correspond 页面中取出 refresh_csrf
+func fetchRefreshCsrf(timestamp int64) (string, error) {
+	path, err := correspondPath(timestamp)
+	if err != nil {
+		return "", err
+	}
+	req := biligo.Chain{Req: biligo.NewGet(URL_CORRESPOND + path)}
+	err = req.Do()
+	if err != nil {
+		return "", err
+	}
+	m := refreshCsrfRegexp.FindStringSubmatch(req.Body)
+	if m == nil {
+		return "", fmt.Errorf("refresh_csrf not found")
+	}
+	return m[1], nil
+}
+
+// mergeCookie 用 Set-Cookie 更新 cookie 中的同名项, 保留其余项 (buvid3 等)
+func mergeCookie(cookie string, setCookies []string) string {
+	var keys []string
+	values := map[string]string{}
+	set := func(kv string) {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || k == "" {
+			return
+		}
+		if _, exists := values[k]; !exists {
+			keys = append(keys, k)
+		}
+		values[k] = v
+	}
+	for part := range strings.SplitSeq(cookie, ";") {
+		set(part)
+	}
+	for _, c := range setCookies {
+		kv, _, _ := strings.Cut(c, ";")
+		set(kv)
+	}
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + values[k]
+	}
+	return strings.Join(parts, "; ")
+}
+
+// refreshCookie 执行完整的刷新流程并保存新的凭据
+func refreshCookie(timestamp int64) error {
+	old := biligo.ExportIdentity()
+	if old.RefreshToken == "" {
+		return fmt.Errorf("no refresh token, %w", errReloginRequired)
+	}
+
+	refreshCsrf, err := fetchRefreshCsrf(timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to fetch refresh_csrf: %w", err)
+	}
+
+	form := netUrl.Values{
+		"csrf":          {csrfToken()},
+		"refresh_csrf":  {refreshCsrf},
+		"source":        {"main_web"},
+		"refresh_token": {old.RefreshToken},
+	}
+	req := biligo.Chain{Req: biligo.NewPost(URL_COOKIE_REFRESH,
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))}
+	err = req.Do()
+	if err != nil {
+		return fmt.Errorf("failed to refresh cookie: %w", err)
+	}
+	var refreshToken string
+	err = req.ParseTo(&refreshToken, "data", "refresh_token")
+	if err != nil {
+		return fmt.Errorf("failed to parse refresh token: %w", err)
+	}
+	setCookies := req.Resp.Header.Values("Set-Cookie")
+	if len(setCookies) == 0 {
+		return fmt.Errorf("no cookie in refresh response")
+	}
+
+	err = biligo.ImportIdentity(biligo.Identity{
+		Cookie:       mergeCookie(old.Cookie, setCookies),
+		RefreshToken: refreshToken,
+		Uid:          old.Uid,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import refreshed identity: %w", err)
+	}
+	err = saveIdentity()
+	if err != nil {
+		return fmt.Errorf("failed to save refreshed identity: %w", err)
+	}
+
+	// 确认失败不影响新 cookie 的使用, 只是旧的 refresh_token 不会立即失效
+	form = netUrl.Values{
+		"csrf":          {csrfToken()},
+		"refresh_token": {old.RefreshToken},
+	}
+	req = biligo.Chain{Req: biligo.NewPost(URL_CONFIRM_REFRESH,
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))}
+	err = req.Do()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to confirm cookie refresh")
+	}
+	return nil
+}
+
+// checkAndRefreshCookie 需要时刷新 cookie
+func checkAndRefreshCookie() {
+	if biligo.ExportIdentity().Uid == 0 {
+		return
+	}
+
+	refresh, timestamp, err := checkCookieRefresh()
+	switch {
+	case err == errReloginRequired:
+		log.Error().
+			Msg("Cookie expired, re-login required (-login or /login)")
+		return
+	case err != nil:
+		log.Warn().
+			Err(err).
+			Msg("Failed to check cookie")
+		return
+	case !refresh:
+		log.Debug().
+			Msg("Cookie is still valid")
+		return
+	}
+
+	log.Info().
+		Msg("Refreshing cookie...")
+	err = refreshCookie(timestamp)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to refresh cookie, re-login may be required (-login or /login)")
+		return
+	}
+	log.Info().
+		Msg("Cookie refreshed")
+	refreshAccount()
+}
+
+// startCookieRefresh 启动时及之后定期检查并刷新 cookie
+func startCookieRefresh(ctx context.Context) {
+	checkAndRefreshCookie()
+
+	ticker := time.NewTicker(COOKIE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			checkAndRefreshCookie()
+		}
+	}
+}
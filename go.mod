@@ -6,6 +6,8 @@ require (
 	github.com/Miuzarte/biligo v0.0.0-20260227063209-7d58629fe8f4
 	github.com/mdp/qrterminal/v3 v3.2.1
 	github.com/rs/zerolog v1.34.0
+	golang.org/x/crypto v0.54.0
+	rsc.io/qr v0.2.0
 )
 
 // replace github.com/Miuzarte/biligo => ..\biligo
@@ -18,7 +20,6 @@ require (
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.2.0 // indirect
 	github.com/tidwall/pretty v1.2.1 // indirect
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/term v0.13.0 // indirect
-	rsc.io/qr v0.2.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/term v0.45.0 // indirect
 )
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+// 容器部署时通过环境变量提供凭据/密钥
+const (
+	ENV_IDENTITY            = `BPROXY_IDENTITY`      // 凭据 json
+	ENV_IDENTITY_FILE       = `BPROXY_IDENTITY_FILE` // 凭据文件, 如 /run/secrets/bilibili_identity
+	ENV_IDENTITY_PASSPHRASE = `BPROXY_IDENTITY_PASSPHRASE`
+)
+
+const IDENTITY_CIPHER = `scrypt-aes256gcm`
+
+// scrypt 参数, 修改后无法解密已有的文件
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+// 默认账号的凭据路径, 由 -identity 决定
+var identityFile string
+
+// initIdentityPath 确定凭据路径, 默认为用户配置目录,
+// 兼容旧版本保存在工作目录下的 bilibili_identity
+func initIdentityPath() {
+	if *fIdentity != "" {
+		identityFile = *fIdentity
+		return
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Failed to get user config dir, using working directory for identity")
+		identityFile = IDENTITY_FILENAME
+		return
+	}
+	identityFile = filepath.Join(dir, "BiliProxyM3U8", IDENTITY_FILENAME)
+
+	_, errNew := os.Stat(identityFile)
+	_, errOld := os.Stat(IDENTITY_FILENAME)
+	if os.IsNotExist(errNew) && errOld == nil {
+		log.Warn().
+			Str("path", IDENTITY_FILENAME).
+			Str("newPath", identityFile).
+			Msg("Using identity in working directory, move it to the new path or specify -identity")
+		identityFile = IDENTITY_FILENAME
+	}
+}
+
+// identitySecret 加密凭据所用的密钥, 为 nil 时明文保存
+func identitySecret() ([]byte, error) {
+	if *fIdentityKeyFile != "" {
+		key, err := os.ReadFile(*fIdentityKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity key file: %w", err)
+		}
+		key = bytes.TrimRight(key, "\r\n")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("identity key file is empty")
+		}
+		return key, nil
+	}
+	if passphrase := os.Getenv(ENV_IDENTITY_PASSPHRASE); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// encryptedIdentity 加密后的凭据文件, []byte 以 base64 保存
+type encryptedIdentity struct {
+	Cipher     string `json:"cipher"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// identityAEAD 从密钥与盐派生 AES-256-GCM
+func identityAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(secret, salt, SCRYPT_N, SCRYPT_R, SCRYPT_P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodeIdentity 序列化凭据, 配置了密钥时加密
+func encodeIdentity(id biligo.Identity) ([]byte, error) {
+	plain, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := identitySecret()
+	if err != nil || secret == nil {
+		return plain, err
+	}
+
+	enc := encryptedIdentity{
+		Cipher: IDENTITY_CIPHER,
+		Salt:   make([]byte, 16),
+	}
+	rand.Read(enc.Salt)
+	aead, err := identityAEAD(secret, enc.Salt)
+	if err != nil {
+		return nil, err
+	}
+	enc.Nonce = make([]byte, aead.NonceSize())
+	rand.Read(enc.Nonce)
+	enc.Ciphertext = aead.Seal(nil, enc.Nonce, plain, nil)
+	return json.Marshal(enc)
+}
+
+// decodeIdentity 解析凭据, 兼容明文与加密两种格式
+func decodeIdentity(data []byte) (id biligo.Identity, encrypted bool, err error) {
+	var enc encryptedIdentity
+	err = json.Unmarshal(data, &enc)
+	if err != nil {
+		return id, false, err
+	}
+	if enc.Cipher == "" {
+		err = json.Unmarshal(data, &id)
+		return id, false, err
+	}
+	if enc.Cipher != IDENTITY_CIPHER {
+		return id, true, fmt.Errorf("unsupported identity cipher: %s", enc.Cipher)
+	}
+
+	secret, err := identitySecret()
+	if err != nil {
+		return id, true, err
+	}
+	if secret == nil {
+		return id, true, fmt.Errorf("identity is encrypted, specify -identity-key-file or %s", ENV_IDENTITY_PASSPHRASE)
+	}
+	aead, err := identityAEAD(secret, enc.Salt)
+	if err != nil {
+		return id, true, err
+	}
+	if len(enc.Nonce) != aead.NonceSize() {
+		return id, true, fmt.Errorf("invalid identity nonce")
+	}
+	plain, err := aead.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+	if err != nil {
+		return id, true, errors.New("failed to decrypt identity, wrong key?")
+	}
+	err = json.Unmarshal(plain, &id)
+	return id, true, err
+}
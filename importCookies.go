@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 登录所需的 cookie
+var requiredCookies = []string{"SESSDATA", "bili_jct", "DedeUserID"}
+
+// parseCookiesTxt 解析 Netscape cookies.txt, 只取 bilibili.com 下的 cookie,
+// 过期的 cookie 会被忽略
+func parseCookiesTxt(s string) (kvs []string) {
+	now := time.Now().Unix()
+	for line := range strings.Lines(s) {
+		line = strings.TrimRight(line, "\r\n")
+		// curl/浏览器扩展以此前缀导出 HttpOnly 的 cookie
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain, expires, name, value := fields[0], fields[4], fields[5], fields[6]
+		if !strings.HasSuffix(strings.TrimPrefix(domain, "."), "bilibili.com") {
+			continue
+		}
+		if exp, _ := strconv.ParseInt(expires, 10, 64); exp > 0 && exp < now {
+			log.Warn().
+				Str("name", name).
+				Time("expires", time.Unix(exp, 0)).
+				Msg("Skipping expired cookie")
+			continue
+		}
+		kvs = append(kvs, name+"="+value)
+	}
+	return kvs
+}
+
+// parseImportedCookies 解析 cookies.txt 或 Cookie 请求头,
+// 另外接受 ac_time_value (网页 localStorage 中的 refresh_token) 用于自动刷新
+func parseImportedCookies(s string) (biligo.Identity, error) {
+	id := biligo.Identity{}
+	var cookie string
+	if kvs := parseCookiesTxt(s); len(kvs) > 0 {
+		cookie = mergeCookie("", kvs)
+	} else {
+		s = strings.TrimSpace(s)
+		if k, v, ok := strings.Cut(s, ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Cookie") {
+			s = v
+		}
+		cookie = mergeCookie(s, nil)
+	}
+
+	values := map[string]string{}
+	var parts []string
+	for part := range strings.SplitSeq(cookie, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "ac_time_value" {
+			id.RefreshToken = v
+			continue
+		}
+		values[k] = v
+		parts = append(parts, k+"="+v)
+	}
+	for _, name := range requiredCookies {
+		if values[name] == "" {
+			return id, fmt.Errorf("missing cookie %s", name)
+		}
+	}
+	uid, err := strconv.Atoi(values["DedeUserID"])
+	if err != nil {
+		return id, fmt.Errorf("invalid DedeUserID: %s", values["DedeUserID"])
+	}
+
+	id.Cookie = strings.Join(parts, "; ")
+	id.Uid = uid
+	return id, nil
+}
+
+// importCookies 从文件 ("-" 为标准输入) 导入 cookie 并保存为凭据
+func importCookies(path string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cookies: %w", err)
+	}
+
+	id, err := parseImportedCookies(string(data))
+	if err != nil {
+		return err
+	}
+	biligo.ImportIdentity(id)
+
+	nav, err := biligo.FetchNav()
+	switch {
+	case err != nil:
+		log.Warn().
+			Err(err).
+			Msg("Failed to verify imported cookies, saving anyway")
+	case !nav.IsLogin:
+		return fmt.Errorf("imported cookies are not logged in, SESSDATA may have expired")
+	default:
+		log.Info().
+			Int("uid", nav.Mid).
+			Str("uname", nav.Uname).
+			Msg("Imported cookies verified")
+	}
+	if id.RefreshToken == "" {
+		log.Warn().
+			Msg("No ac_time_value in imported cookies, automatic cookie refresh is unavailable")
+	}
+
+	err = saveIdentity()
+	if err != nil {
+		return fmt.Errorf("failed to save identity: %w", err)
+	}
+	log.Info().
+		Str("path", identityPath(*fAccount)).
+		Msg("Cookies imported")
+	return nil
+}
@@ -2,64 +2,121 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/Miuzarte/biligo"
 	"github.com/mdp/qrterminal/v3"
 	"github.com/rs/zerolog/log"
 )
 
-const IDENTITY_FILENAME = `bilibili_identity`
+const (
+	IDENTITY_FILENAME = `bilibili_identity`
+	// 具名账号的凭据目录, 每个账号一个文件
+	IDENTITY_DIR = `bilibili_identities`
+)
+
+var accountNameRegexp = regexp.MustCompile(`^[0-9A-Za-z_-]*$`)
+
+// validAccountName 账号名会用作文件名, 空为默认账号
+func validAccountName(name string) bool {
+	return accountNameRegexp.MatchString(name)
+}
+
+// identityPath 账号凭据的路径, 具名账号保存在默认凭据旁的 bilibili_identities 中
+func identityPath(account string) string {
+	if account == "" {
+		return identityFile
+	}
+	return filepath.Join(filepath.Dir(identityFile), IDENTITY_DIR, account)
+}
+
+// readIdentity 读取账号的凭据,
+// 默认账号的文件不存在时从环境变量 BPROXY_IDENTITY / BPROXY_IDENTITY_FILE 读取
+func readIdentity(account string) (id biligo.Identity, encrypted bool, err error) {
+	data, err := os.ReadFile(identityPath(account))
+	if os.IsNotExist(err) && account == "" {
+		switch {
+		case os.Getenv(ENV_IDENTITY) != "":
+			data, err = []byte(os.Getenv(ENV_IDENTITY)), nil
+		case os.Getenv(ENV_IDENTITY_FILE) != "":
+			data, err = os.ReadFile(os.Getenv(ENV_IDENTITY_FILE))
+		}
+	}
+	if err != nil {
+		return id, false, err
+	}
+	return decodeIdentity(data)
+}
 
 func loadIdentity() bool {
-	f, err := os.OpenFile(IDENTITY_FILENAME, os.O_RDONLY, 0o600)
+	id, encrypted, err := readIdentity(*fAccount)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Info().
-				Msg("bilibili_identity not exist, need login")
+				Str("path", identityPath(*fAccount)).
+				Msg("Identity not exist, need login")
 		} else {
-			log.Error().
+			// 继续运行会在扫码登录后覆盖无法读取的凭据
+			log.Fatal().
 				Err(err).
-				Msg("Failed to open identity file")
+				Str("path", identityPath(*fAccount)).
+				Msg("Failed to read identity")
 		}
 		return false
 	}
-	defer f.Close()
-
-	id := biligo.Identity{}
-	err = json.NewDecoder(f).Decode(&id)
-	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Failed to decode identity")
-		return false
-	}
 	biligo.ImportIdentity(id)
 	log.Info().
+		Str("account", *fAccount).
+		Bool("encrypted", encrypted).
 		Msg("Identity loaded successfully")
+
+	// 配置了密钥后, 将明文凭据改为加密保存
+	if secret, _ := identitySecret(); secret != nil && !encrypted {
+		if saveIdentity() == nil {
+			log.Info().
+				Str("path", identityPath(*fAccount)).
+				Msg("Identity encrypted")
+		}
+	}
 	return true
 }
 
 func saveIdentity() error {
-	id := biligo.ExportIdentity()
-	f, err := os.OpenFile(IDENTITY_FILENAME, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	data, err := encodeIdentity(biligo.ExportIdentity())
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Failed to open identity file for writing")
+			Msg("Failed to encode identity")
 		return err
 	}
-	defer f.Close()
-
-	err = json.NewEncoder(f).Encode(id)
+	path := identityPath(*fAccount)
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Failed to encode identity")
+			Msg("Failed to create identity directory")
+		return err
+	}
+	// 先写入临时文件再替换, 避免写入中断时丢失凭据
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Error().
+			Err(err).
+			Str("path", path).
+			Msg("Failed to write identity")
 		return err
 	}
+	forgetNamedIdentity(*fAccount)
 	return nil
 }
 
@@ -80,8 +137,13 @@ func qrcodeLogin(ctx context.Context) error {
 		QuietZone: 1,
 		WithSixel: qrterminal.IsSixelSupported(os.Stdout),
 	})
-	log.Info().
-		Msg("Scan the QR code with Bilibili app")
+	if *fLoginOnly || !*fWebLogin {
+		log.Info().
+			Msg("Scan the QR code with Bilibili app")
+	} else {
+		log.Info().
+			Msg("Scan the QR code with Bilibili app, or open /login in a browser")
+	}
 
 	for code, err := range it {
 		if err != nil {
@@ -102,9 +164,14 @@ func qrcodeLogin(ctx context.Context) error {
 			if err != nil {
 				return fmt.Errorf("failed to save identity: %w", err)
 			}
+			refreshAccount()
 			return nil
 
 		case biligo.LOGIN_CODE_STATE_EXPIRED:
+			// 可能已经在网页上登录
+			if biligo.ExportIdentity().Uid != 0 {
+				return nil
+			}
 			log.Warn().
 				Msg("QR code expired")
 			return fmt.Errorf("qr code expired")
@@ -117,3 +184,25 @@ func qrcodeLogin(ctx context.Context) error {
 
 	return fmt.Errorf("login flow ended unexpectedly")
 }
+
+// requireLogin 需要登录的接口使用, 未登录时写入 401
+func requireLogin(w http.ResponseWriter) (uid int, ok bool) {
+	uid = biligo.ExportIdentity().Uid
+	if uid == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "Not logged in, run with -login first")
+		return 0, false
+	}
+	return uid, true
+}
+
+// csrfToken 从 cookie 中取出 bili_jct, 用于 POST 接口的 csrf 参数
+func csrfToken() string {
+	for part := range strings.SplitSeq(biligo.ExportCookie(), ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "bili_jct" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+	"rsc.io/qr"
+)
+
+// 网页扫码登录的二维码有效期为 180s, 之后轮询也没有意义
+const WEB_LOGIN_TIMEOUT = 3 * time.Minute
+
+// webLoginSession 网页扫码登录, 同时只有一个二维码
+type webLoginSession struct {
+	mu        sync.Mutex
+	qrcodeUrl string
+	state     biligo.LoginCodeState
+	err       error
+	cancel    context.CancelFunc
+}
+
+var webLogin = &webLoginSession{state: -1}
+
+// loginStatus /v1/login/status 返回的 json
+type loginStatus struct {
+	State    string `json:"state"` // none, unscanned, scanned, success, expired, error
+	Code     int    `json:"code"`
+	LoggedIn bool   `json:"logged_in"`
+	Uid      int    `json:"uid,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// active 二维码仍可扫码
+func (s *webLoginSession) active() bool {
+	return s.qrcodeUrl != "" && s.err == nil &&
+		(s.state == -1 || s.state == biligo.LOGIN_CODE_STATE_UNSCANNED || s.state == biligo.LOGIN_CODE_STATE_SCANNED)
+}
+
+// qrcode 返回当前可用的二维码内容, 没有或已失效时重新生成
+func (s *webLoginSession) qrcode() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active() {
+		return s.qrcodeUrl, nil
+	}
+
+	ctx, cancel := context.WithTimeout(cwg.Ctx, WEB_LOGIN_TIMEOUT)
+	qrcodeUrl, it, err := biligo.Login(ctx)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.qrcodeUrl, s.state, s.err, s.cancel = qrcodeUrl, -1, nil, cancel
+
+	cwg.Go(func(_ context.Context) {
+		defer cancel()
+		s.poll(ctx, qrcodeUrl, it)
+	})
+	return qrcodeUrl, nil
+}
+
+// poll 更新登录状态, 成功后保存凭据
+func (s *webLoginSession) poll(ctx context.Context, qrcodeUrl string, it iter.Seq2[biligo.LoginCodeState, error]) {
+	for code, err := range it {
+		if ctx.Err() != nil {
+			// 超时或退出
+			s.update(qrcodeUrl, biligo.LOGIN_CODE_STATE_EXPIRED, nil)
+			return
+		}
+		if code == -1 {
+			log.Warn().
+				Err(err).
+				Msg("Failed to poll web login status")
+			continue
+		}
+
+		switch code {
+		case biligo.LOGIN_CODE_STATE_SUCCESS:
+			if err == nil {
+				log.Info().
+					Int("uid", biligo.ExportIdentity().Uid).
+					Msg("Web login successful!")
+				err = saveIdentity()
+				refreshAccount()
+			}
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("Web login failed")
+			}
+			s.update(qrcodeUrl, code, err)
+			return
+
+		case biligo.LOGIN_CODE_STATE_EXPIRED:
+			log.Info().
+				Msg("Web login QR code expired")
+			s.update(qrcodeUrl, code, nil)
+			return
+
+		case biligo.LOGIN_CODE_STATE_SCANNED:
+			log.Info().
+				Msg("Web login QR code scanned, waiting for confirmation...")
+		}
+		if !s.update(qrcodeUrl, code, err) {
+			return
+		}
+	}
+}
+
+// update 更新状态, 二维码已被替换时返回 false
+func (s *webLoginSession) update(qrcodeUrl string, state biligo.LoginCodeState, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.qrcodeUrl != qrcodeUrl {
+		return false
+	}
+	s.state, s.err = state, err
+	return true
+}
+
+// reset 退出登录后丢弃之前的扫码状态
+func (s *webLoginSession) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.qrcodeUrl, s.state, s.err = "", -1, nil
+}
+
+// status 当前登录状态
+func (s *webLoginSession) status() loginStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := loginStatus{
+		State: "none",
+		Code:  int(s.state),
+		Uid:   biligo.ExportIdentity().Uid,
+	}
+	status.LoggedIn = status.Uid != 0
+	switch {
+	case s.err != nil:
+		status.State = "error"
+		status.Error = s.err.Error()
+	case s.qrcodeUrl == "":
+	case s.state == -1:
+		status.State = "unscanned"
+	default:
+		status.State = s.state.String()
+		// biligo 中的拼写
+		switch s.state {
+		case biligo.LOGIN_CODE_STATE_SCANNED:
+			status.State = "scanned"
+		case biligo.LOGIN_CODE_STATE_UNSCANNED:
+			status.State = "unscanned"
+		}
+	}
+	return status
+}
+
+// apiLoginPage 网页扫码登录, 用于无法查看终端的环境
+func apiLoginPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := LoginTemplate.Execute(w, LoginPageData{
+		Uid:     biligo.ExportIdentity().Uid,
+		Replace: r.URL.Query().Get("replace") == "1",
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to execute login template")
+	}
+}
+
+// apiLoginQrcode 当前二维码的 png, 没有或已失效时重新生成,
+// 已登录时需要 replace=1 确认切换账号
+func apiLoginQrcode(w http.ResponseWriter, r *http.Request) {
+	if biligo.ExportIdentity().Uid != 0 && r.URL.Query().Get("replace") != "1" {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, "Already logged in, use replace=1 to switch account")
+		return
+	}
+	qrcodeUrl, err := webLogin.qrcode()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to fetch QR code")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	code, err := qr.Encode(qrcodeUrl, qr.L)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	code.Scale = 8
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(code.PNG())
+}
+
+// apiLoginStatus 登录状态
+func apiLoginStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, webLogin.status())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"os"
+	"strings"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 退出登录, POST, 使 SESSDATA 失效, 已退出时 code 为 -101
+//
+//	biliCSRF
+const URL_LOGOUT = `https://passport.bilibili.com/login/exit/v2`
+
+// 登录后才有的 cookie, 退出后从 cookie 中移除
+var loginCookies = map[string]bool{
+	"SESSDATA":          true,
+	"bili_jct":          true,
+	"DedeUserID":        true,
+	"DedeUserID__ckMd5": true,
+	"sid":               true,
+}
+
+// revokeSession 调用退出登录接口使凭据在服务端失效
+func revokeSession(id biligo.Identity) error {
+	var csrf string
+	for part := range strings.SplitSeq(id.Cookie, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "bili_jct" {
+			csrf = v
+		}
+	}
+	form := netUrl.Values{"biliCSRF": {csrf}}
+	req, err := http.NewRequest(http.MethodPost, URL_LOGOUT, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	for k, v := range biligo.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", id.Cookie)
+
+	resp, err := accountClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return fmt.Errorf("failed to decode logout response: %w", err)
+	}
+	if body.Code != 0 && body.Code != -101 {
+		return fmt.Errorf("code %d: %s", body.Code, body.Message)
+	}
+	return nil
+}
+
+// hasSession cookie 中有非空的 SESSDATA
+func hasSession(cookie string) bool {
+	for part := range strings.SplitSeq(cookie, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "SESSDATA" && v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// guestCookie 去掉 cookie 中登录相关的项, 保留 buvid3 等访客 cookie
+func guestCookie(cookie string) string {
+	var parts []string
+	for part := range strings.SplitSeq(cookie, ";") {
+		k, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k != "" && !loginCookies[k] {
+			parts = append(parts, strings.TrimSpace(part))
+		}
+	}
+	if len(parts) == 0 {
+		// biligo 不接受空 cookie, 用空的 SESSDATA 表示未登录
+		return "SESSDATA="
+	}
+	return strings.Join(parts, "; ")
+}
+
+// logout 退出账号并删除保存的凭据, account 为空时为默认账号,
+// 服务端退出失败时仍会删除本地凭据
+func logout(account string) error {
+	var id biligo.Identity
+	if account == "" {
+		id = biligo.ExportIdentity()
+	} else {
+		var err error
+		id, err = namedIdentity(account)
+		if err != nil {
+			return err
+		}
+	}
+	if id.Uid == 0 && !hasSession(id.Cookie) {
+		return fmt.Errorf("not logged in")
+	}
+
+	revokeErr := revokeSession(id)
+	if revokeErr != nil {
+		log.Warn().
+			Err(revokeErr).
+			Str("account", account).
+			Msg("Failed to revoke session, removing local identity anyway")
+	}
+
+	// 默认账号的凭据由 -account 决定
+	name := account
+	if name == "" {
+		name = *fAccount
+	}
+	path := identityPath(name)
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove identity: %w", err)
+	}
+	if name == "" && (os.Getenv(ENV_IDENTITY) != "" || os.Getenv(ENV_IDENTITY_FILE) != "") {
+		log.Warn().
+			Msg("Identity is also provided by environment, remove it to stay logged out after restart")
+	}
+
+	if account == "" {
+		err = biligo.ImportIdentity(biligo.Identity{Cookie: guestCookie(id.Cookie)})
+		if err != nil {
+			return fmt.Errorf("failed to reset identity: %w", err)
+		}
+		webLogin.reset()
+		clearCaches()
+		// 进度上报与稍后再看的删除都以默认账号进行
+		progressMu.Lock()
+		clear(progressSessions)
+		progressMu.Unlock()
+		watchLaterPendingMu.Lock()
+		clear(watchLaterPending)
+		watchLaterPendingMu.Unlock()
+		accountMu.Lock()
+		accounts[""] = accountInfo{}
+		accountMu.Unlock()
+	} else {
+		clearAccountCaches(account)
+	}
+	forgetNamedIdentity(name)
+
+	log.Info().
+		Str("account", name).
+		Int("uid", id.Uid).
+		Str("path", path).
+		Msg("Logged out")
+	return nil
+}
+
+// LOGOUT_HEADER 自定义请求头使跨域请求需要预检, 而本服务不响应预检,
+// 网页无法在用户不知情时让服务退出登录
+const LOGOUT_HEADER = "X-BProxy-Logout"
+
+// sameOrigin 浏览器发出的请求必须来自本服务的页面, 非浏览器客户端不带 Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := netUrl.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// apiLogout 退出登录, account 指定具名账号, 不按 -account-rules 选择,
+// 需要带上 X-BProxy-Logout: 1
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(LOGOUT_HEADER) != "1" || !sameOrigin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Logout requires the %s: 1 header from the same origin", LOGOUT_HEADER)
+		return
+	}
+	// 只退出明确指定的账号, 避免按客户端匹配的规则退出了具名账号
+	account := r.URL.Query().Get("account")
+	if account == *fAccount {
+		account = ""
+	}
+	if !validAccountName(account) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid account %q", account)
+		return
+	}
+
+	err := logout(account)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("account", account).
+			Msg("Failed to logout")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	writeJSON(w, accountInfo{})
+}
@@ -44,6 +44,27 @@ var (
 
 	fLoginOnly = flag.Bool("login", false,
 		"Only perform login and exit")
+	fWebLogin = flag.Bool("web-login", false,
+		"Enable QR code login in the browser at /login, anyone who can reach the server can then log it in")
+	fImportCookies = flag.String("import-cookies", "",
+		"Import cookies from a Netscape cookies.txt or a raw Cookie header file (- for stdin) and exit")
+	fAccount = flag.String("account", "",
+		"Default account name, identities are stored under bilibili_identities/ next to -identity, use with -login to add an account")
+	fIdentity = flag.String("identity", "",
+		"Identity file path (default: <user config dir>/BiliProxyM3U8/bilibili_identity)")
+	fIdentityKeyFile = flag.String("identity-key-file", "",
+		"Encrypt identities at rest with the key in this file (or set BPROXY_IDENTITY_PASSPHRASE)")
+	fAccountRules = flag.String("account-rules", "",
+		"Per-client account selection, comma separated match=account, match is client IP or a User-Agent substring (e.g., 192.168.1.20=vip,Kodi=vip)")
+
+	fImageCache = flag.String("image-cache", "",
+		"Image cache directory (default: <user cache dir>/BiliProxyM3U8/images), -image-cache=off to disable")
+
+	fFFmpeg = flag.String("ffmpeg", "ffmpeg",
+		"ffmpeg path, used to remux /v1/audio into tagged m4a")
+
+	fReportProgress = flag.Bool("report-progress", true,
+		"Report playback progress to Bilibili watch history, -report-progress=false to disable")
 
 	fCodecPriority = flag.String("codec", "hevc,avc,av1",
 		"Codec priority (av1/av01, hevc/h265/h.265, avc/h264/h.264)")
@@ -106,6 +127,13 @@ func init() {
 
 	maxQuality = parseQuality(*fQuality)
 	codecPriority = parseCodecPriority(*fCodecPriority)
+	initIdentityPath()
+	parseAccountRules(*fAccountRules)
+	if !validAccountName(*fAccount) {
+		log.Fatal().
+			Str("account", *fAccount).
+			Msg("Invalid account name")
+	}
 
 	log.Info().
 		Str("listen", server.Addr).
@@ -125,6 +153,55 @@ func main() {
 	// query p 返回 MPD
 	http.HandleFunc("GET /v1/video/{id}", apiVideo)
 	http.HandleFunc("GET /v1/proxy", apiProxy)
+	http.HandleFunc("GET /v1/chapters/{id}", apiChapters)
+	http.HandleFunc("GET /v1/thumbnails/{id}", apiThumbnails)
+	http.HandleFunc("GET /v1/thumbnails/{id}/{n}", apiThumbnailSprite)
+	http.HandleFunc("GET /v1/image", apiImage)
+	http.HandleFunc("GET /v1/fav", apiFavFolders)
+	http.HandleFunc("GET /v1/fav/{mediaId}", apiFav)
+	http.HandleFunc("GET /v1/watchlater", apiWatchLater)
+	http.HandleFunc("GET /v1/collection/{mid}/{seasonId}", apiCollection)
+	http.HandleFunc("GET /v1/series/{mid}/{seriesId}", apiSeries)
+	http.HandleFunc("GET /v1/space/{mid}", apiSpace)
+	http.HandleFunc("GET /v1/audio/{id}", apiAudio)
+	http.HandleFunc("GET /v1/search", apiSearch)
+	http.HandleFunc("GET /v1/open", apiOpen)
+	http.HandleFunc("GET /v1/interactive/{id}", apiInteractive)
+	http.HandleFunc("GET /v1/feed/recommend", apiRecommend)
+	http.HandleFunc("GET /v1/popular", apiPopular)
+	http.HandleFunc("GET /v1/ranking/{rid}", apiRanking)
+	http.HandleFunc("GET /v1/dynamic", apiDynamic)
+	if *fWebLogin {
+		http.HandleFunc("GET /login", apiLoginPage)
+		http.HandleFunc("GET /login/qrcode.png", apiLoginQrcode)
+		http.HandleFunc("GET /v1/login/status", apiLoginStatus)
+	}
+	http.HandleFunc("GET /v1/account", apiAccount)
+	http.HandleFunc("POST /v1/logout", apiLogout)
+	http.HandleFunc("POST /v1/progress", apiProgress)
+
+	if flag.Arg(0) == "logout" {
+		if !loadIdentity() {
+			return
+		}
+		err := logout("")
+		if err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Failed to logout")
+		}
+		return
+	}
+
+	if *fImportCookies != "" {
+		err := importCookies(*fImportCookies)
+		if err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Failed to import cookies")
+		}
+		return
+	}
 
 	switch {
 	case !loadIdentity():
@@ -146,10 +223,25 @@ func main() {
 		return
 	}
 
+	// 只有服务需要图片缓存, 登录/导入等子命令不创建目录
+	initImageCache()
+
+	cwg.Go(func(_ context.Context) {
+		refreshAccount()
+	})
+
 	cwg.Go(func(ctx context.Context) {
 		startCacheCleanup(ctx)
 	})
 
+	cwg.Go(func(ctx context.Context) {
+		startCookieRefresh(ctx)
+	})
+
+	cwg.Go(func(ctx context.Context) {
+		startProgressReport(ctx)
+	})
+
 	cwg.Go(func(_ context.Context) {
 		log.Info().
 			Str("addr", server.Addr).
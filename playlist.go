@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"strings"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/rs/zerolog/log"
+)
+
+// writeM3U8 补全 MaxDuration 并输出播放列表
+func writeM3U8(w http.ResponseWriter, filename string, data M3u8Data) {
+	for _, item := range data.Items {
+		if item.Duration > data.MaxDuration {
+			data.MaxDuration = item.Duration
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.m3u8\"", filename))
+
+	err := M3u8Template.Execute(w, data)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to execute M3U8 template")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// writeJSON 以 json 输出, 供 UI 使用
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to encode json")
+	}
+}
+
+// wantJSON query format=json 时返回 json 而非 M3U8
+func wantJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json"
+}
+
+// listVideoItems 将列表接口中的一个视频生成为播放列表项,
+// 默认指向该视频的 M3U8,
+// expand 时单P直接指向 MPD, 多P或分P数未知 (pages <= 0) 时获取视频信息后展开
+func listVideoItems(baseUrl, bvid string, pages int, expand bool, item M3u8Item) []M3u8Item {
+	switch {
+	case !expand:
+		item.URL = fmt.Sprintf("%s/v1/video/%s", baseUrl, bvid)
+		return []M3u8Item{item}
+
+	case pages == 1:
+		item.URL = fmt.Sprintf("%s/v1/video/%s?p=1", baseUrl, bvid)
+		return []M3u8Item{item}
+	}
+
+	vInfo, err := getVideoInfo(bvid)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("bvid", bvid).
+			Msg("Failed to fetch video info, not expanded")
+		item.URL = fmt.Sprintf("%s/v1/video/%s", baseUrl, bvid)
+		return []M3u8Item{item}
+	}
+	if len(vInfo.Pages) == 1 {
+		item.URL = fmt.Sprintf("%s/v1/video/%s?p=1", baseUrl, bvid)
+		return []M3u8Item{item}
+	}
+	items := videoM3u8Items(baseUrl, bvid, vInfo)
+	for i := range items {
+		items[i].Title = fmt.Sprintf("%s - %s", vInfo.Title, items[i].Title)
+		items[i].Group = item.Group
+	}
+	return items
+}
+
+// appendQuery 为 url 附加一个 query 参数
+func appendQuery(url, key, value string) string {
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + netUrl.QueryEscape(key) + "=" + netUrl.QueryEscape(value)
+}
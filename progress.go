@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	netUrl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 播放心跳, POST, 上报到历史记录
+//
+//	aid, cid, played_time, start_ts, type=3, dt=2, play_type, csrf
+const URL_HEARTBEAT = `https://api.bilibili.com/x/click-interface/web/heartbeat`
+
+const (
+	HEARTBEAT_INTERVAL = 15 * time.Second
+	// 超过该时间没有新的进度视为停止播放
+	PROGRESS_IDLE_TIMEOUT = 5 * time.Minute
+	// 流地址约 2 小时后失效
+	STREAM_TTL = 2 * time.Hour
+	// sidx 只有几 KB, CDN 卡住时不应一直占用
+	SIDX_FETCH_TIMEOUT = 15 * time.Second
+)
+
+var sidxClient = &http.Client{Timeout: SIDX_FETCH_TIMEOUT}
+
+// streamInfo 代理的流所属的视频, 用于从 Range 推断播放位置
+type streamInfo struct {
+	aid        int
+	cid        int
+	indexRange string // sidx 所在的字节范围 "a-b"
+
+	once  sync.Once
+	index *sidxIndex
+	err   error
+}
+
+// sidxIndex 每个分段的起始字节与起始时间(s)
+type sidxIndex struct {
+	offsets []int64
+	times   []float64
+}
+
+// timeAt 字节偏移所在分段的起始时间, 在第一个分段之前时返回 false
+func (idx *sidxIndex) timeAt(offset int64) (float64, bool) {
+	i := sort.Search(len(idx.offsets), func(i int) bool {
+		return idx.offsets[i] > offset
+	}) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return idx.times[i], true
+}
+
+// parseSidx 解析 indexRange 起始处的 sidx box,
+// 分段从 sidx 之后 first_offset 处开始
+func parseSidx(data []byte, indexEnd int64) (*sidxIndex, error) {
+	if len(data) < 8 || string(data[4:8]) != "sidx" {
+		return nil, fmt.Errorf("not a sidx box")
+	}
+	r := data[8:]
+	read := func(n int) uint64 {
+		if len(r) < n {
+			r = nil
+			return 0
+		}
+		var v uint64
+		for _, b := range r[:n] {
+			v = v<<8 | uint64(b)
+		}
+		r = r[n:]
+		return v
+	}
+
+	version := read(1)
+	read(3) // flags
+	read(4) // reference_ID
+	timescale := read(4)
+	var earliest, firstOffset uint64
+	if version == 0 {
+		earliest, firstOffset = read(4), read(4)
+	} else {
+		earliest, firstOffset = read(8), read(8)
+	}
+	read(2) // reserved
+	count := int(read(2))
+	if r == nil || timescale == 0 {
+		return nil, fmt.Errorf("truncated sidx box")
+	}
+
+	idx := &sidxIndex{
+		offsets: make([]int64, 0, count),
+		times:   make([]float64, 0, count),
+	}
+	offset := indexEnd + 1 + int64(firstOffset)
+	t := earliest
+	for range count {
+		if len(r) < 12 {
+			return nil, fmt.Errorf("truncated sidx references")
+		}
+		size := binary.BigEndian.Uint32(r) & 0x7fffffff
+		duration := binary.BigEndian.Uint32(r[4:])
+		r = r[12:]
+
+		idx.offsets = append(idx.offsets, offset)
+		idx.times = append(idx.times, float64(t)/float64(timescale))
+		offset += int64(size)
+		t += uint64(duration)
+	}
+	return idx, nil
+}
+
+// fetchSidx 获取流的 sidx
+func fetchSidx(url, indexRange string) (*sidxIndex, error) {
+	_, end, ok := strings.Cut(indexRange, "-")
+	indexEnd, err := strconv.ParseInt(end, 10, 64)
+	if !ok || err != nil {
+		return nil, fmt.Errorf("invalid index range: %s", indexRange)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range biligo.DefaultHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Range", "bytes="+indexRange)
+	resp, err := sidxClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseSidx(data, indexEnd)
+}
+
+// progressWanted 上报历史记录或等待从稍后再看删除时才跟踪播放位置
+func progressWanted(cid int) bool {
+	return *fReportProgress || watchLaterArmed(cid)
+}
+
+// registerStream 记录 MPD 中的流, 之后代理该流时推断播放位置
+func registerStream(url string, aid, cid int, indexRange string) {
+	if !progressWanted(cid) {
+		return
+	}
+	if _, ok := getCached[*streamInfo](streamCache, url); ok {
+		return
+	}
+	setCached(streamCache, url, &streamInfo{
+		aid:        aid,
+		cid:        cid,
+		indexRange: indexRange,
+	}, STREAM_TTL)
+}
+
+// trackRange 从代理请求的 Range 推断播放位置,
+// 推断的是播放器已缓冲到的位置, 通常会比实际播放位置稍靠后,
+// 同一分P的视频与音频流取较小者
+func trackRange(url, rangeHeader string) {
+	stream, ok := getCached[*streamInfo](streamCache, url)
+	if !ok {
+		return
+	}
+	start, _, _ := strings.Cut(strings.TrimPrefix(rangeHeader, "bytes="), "-")
+	offset, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return
+	}
+
+	cwg.Go(func(_ context.Context) {
+		stream.once.Do(func() {
+			stream.index, stream.err = fetchSidx(url, stream.indexRange)
+			if stream.err != nil {
+				log.Warn().
+					Err(stream.err).
+					Int("cid", stream.cid).
+					Msg("Failed to fetch sidx, progress of this stream will not be reported")
+			}
+		})
+		if stream.index == nil {
+			return
+		}
+		// 读取 sidx/初始化段的嗅探请求不算播放
+		if t, ok := stream.index.timeAt(offset); ok {
+			updateProgress(stream.aid, stream.cid, url, int(t))
+		}
+	})
+}
+
+type progressSession struct {
+	aid       int
+	cid       int
+	position  int            // s
+	sources   map[string]int // 流 url -> 推断的位置, 播放器主动上报时为 ""
+	startTs   int64
+	updatedAt time.Time
+	reported  int // 上次上报的位置, -1 为未上报
+}
+
+var (
+	// cid -> 正在播放的会话
+	progressSessions = map[int]*progressSession{}
+	progressMu       sync.Mutex
+)
+
+// updateProgress 更新播放位置, 由后台定期上报,
+// source 为推断位置的流 url, 为空时是播放器主动上报的准确位置
+func updateProgress(aid, cid int, source string, position int) {
+	if !progressWanted(cid) {
+		return
+	}
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	s, ok := progressSessions[cid]
+	if !ok {
+		s = &progressSession{
+			aid:      aid,
+			cid:      cid,
+			sources:  map[string]int{},
+			startTs:  time.Now().Unix(),
+			reported: -1,
+		}
+		progressSessions[cid] = s
+		log.Debug().
+			Int("aid", aid).
+			Int("cid", cid).
+			Msg("Playback started")
+	}
+	if source == "" {
+		// 主动上报的位置优先, 之后推断的位置只能使其更靠前
+		clear(s.sources)
+	}
+	s.sources[source] = position
+	s.position = position
+	for _, p := range s.sources {
+		s.position = min(s.position, p)
+	}
+	s.updatedAt = time.Now()
+	checkWatchLaterProgress(cid, s.position, time.Since(time.Unix(s.startTs, 0)))
+}
+
+// heartbeat 上报播放位置到历史记录
+func heartbeat(s progressSession) error {
+	form := netUrl.Values{
+		"aid":         {strconv.Itoa(s.aid)},
+		"cid":         {strconv.Itoa(s.cid)},
+		"played_time": {strconv.Itoa(s.position)},
+		"start_ts":    {strconv.FormatInt(s.startTs, 10)},
+		"type":        {"3"},
+		"dt":          {"2"},
+		"play_type":   {"0"},
+		"csrf":        {csrfToken()},
+	}
+	req := biligo.Chain{Req: biligo.NewPost(URL_HEARTBEAT,
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))}
+	return doChain(&req)
+}
+
+// reportProgress 上报有变化的会话, 移除停止播放的会话
+func reportProgress() {
+	var pending []progressSession
+	progressMu.Lock()
+	for cid, s := range progressSessions {
+		if s.position != s.reported {
+			pending = append(pending, *s)
+			s.reported = s.position
+		}
+		if time.Since(s.updatedAt) > PROGRESS_IDLE_TIMEOUT {
+			delete(progressSessions, cid)
+		}
+	}
+	progressMu.Unlock()
+	expireWatchLater()
+
+	if !*fReportProgress || len(pending) == 0 || biligo.ExportIdentity().Uid == 0 {
+		return
+	}
+	for _, s := range pending {
+		err := heartbeat(s)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Int("aid", s.aid).
+				Int("cid", s.cid).
+				Msg("Failed to report progress")
+			continue
+		}
+		log.Debug().
+			Int("aid", s.aid).
+			Int("cid", s.cid).
+			Int("position", s.position).
+			Msg("Progress reported")
+	}
+}
+
+// startProgressReport 定期上报播放进度, 退出前上报最后的位置
+func startProgressReport(ctx context.Context) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reportProgress()
+		case <-ctx.Done():
+			reportProgress()
+			return
+		}
+	}
+}
+
+// apiProgress 播放器主动上报播放位置,
+// id: av/BV 号, p: 分P (默认 1), cid: 直接指定分P (优先于 p), t: 位置(s)
+func apiProgress(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireLogin(w); !ok {
+		return
+	}
+
+	id := r.FormValue("id")
+	if id == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Empty id")
+		return
+	}
+	t, err := strconv.ParseFloat(r.FormValue("t"), 64)
+	if err != nil || t < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid t: %s", r.FormValue("t"))
+		return
+	}
+
+	vInfo, err := getVideoInfo(id)
+	if err != nil {
+		writeAPIError(w, err, "Failed to fetch video info")
+		return
+	}
+	cid, _ := strconv.Atoi(r.FormValue("cid"))
+	if cid == 0 {
+		pageNum, err := resolvePageNum(r.FormValue("p"), vInfo)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		cid = vInfo.Pages[pageNum-1].Cid
+	}
+	if !progressWanted(cid) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "Progress reporting is disabled")
+		return
+	}
+
+	updateProgress(vInfo.Aid, cid, "", int(t))
+	w.WriteHeader(http.StatusNoContent)
+}
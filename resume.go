@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"strconv"
+	"time"
+
+	. "github.com/Miuzarte/BiliProxyM3U8/templates"
+
+	"github.com/Miuzarte/biligo"
+	"github.com/rs/zerolog/log"
+)
+
+// 距离结尾不足该时长时视为已看完, 从下一P开始
+const RESUME_END_MARGIN = 10
+
+// resumePoint 历史记录中视频的上次播放位置
+type resumePoint struct {
+	LastPlayCid  int `json:"last_play_cid"`
+	LastPlayTime int `json:"last_play_time"` // ms, 看完时为 -1 或 0
+}
+
+// resumeRequested query resume=1 时从上次播放的位置继续
+func resumeRequested(r *http.Request) bool {
+	return r.URL.Query().Get("resume") == "1"
+}
+
+// fetchResumePoint 从播放器信息中获取上次播放的分P与位置, 需要登录
+func fetchResumePoint(vInfo *biligo.VideoInfo, account string) (resumePoint, error) {
+	// 播放器会多次嗅探, 短暂缓存
+	key := fmt.Sprintf("resume/%d%s", vInfo.Aid, accountSuffix(account))
+	if rp, ok := getCached[resumePoint](playlistCache, key); ok {
+		return rp, nil
+	}
+
+	var rp resumePoint
+	if len(vInfo.Pages) == 0 {
+		return rp, fmt.Errorf("no pages in av%d", vInfo.Aid)
+	}
+	aid, cid := strconv.Itoa(vInfo.Aid), strconv.Itoa(vInfo.Pages[0].Cid)
+	if account == "" {
+		req := biligo.Chain{Req: biligo.NewGet(URL_PLAYER_V2_WBI).WbiSign().
+			WithQuerys("aid", aid, "cid", cid)}
+		err := doChain(&req)
+		if err != nil {
+			return rp, err
+		}
+		err = req.ParseTo(&rp, "data")
+		if err != nil {
+			return rp, err
+		}
+	} else {
+		id, err := namedIdentity(account)
+		if err != nil {
+			return rp, err
+		}
+		err = identityGet(id, URL_PLAYER_V2_WBI, netUrl.Values{"aid": {aid}, "cid": {cid}}, true, &rp)
+		if err != nil {
+			return rp, err
+		}
+	}
+
+	setCached(playlistCache, key, rp, time.Minute)
+	return rp, nil
+}
+
+// resumePage 继续播放的分P与位置(s), 没有记录或全部看完时返回 false
+func (rp resumePoint) resumePage(vInfo *biligo.VideoInfo) (pageNum, start int, ok bool) {
+	for i, page := range vInfo.Pages {
+		if page.Cid != rp.LastPlayCid {
+			continue
+		}
+		start = rp.LastPlayTime / 1000
+		if start > 0 && start < page.Duration-RESUME_END_MARGIN {
+			return i + 1, start, true
+		}
+		// 已看完, 从下一P开始
+		if i+1 < len(vInfo.Pages) {
+			return i + 2, 0, true
+		}
+		return 0, 0, false
+	}
+	return 0, 0, false
+}
+
+// resumeM3u8Items 在继续播放的分P上标记位置, 已看完的分P仍可播放,
+// 返回该位置在整个播放列表中的时间(s), 用于 EXT-X-START
+func resumeM3u8Items(r *http.Request, vInfo *biligo.VideoInfo, items []M3u8Item) int {
+	account, err := requestAccount(r)
+	if err != nil {
+		return 0
+	}
+	rp, err := fetchResumePoint(vInfo, account)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("aid", vInfo.Aid).
+			Msg("Failed to fetch resume point")
+		return 0
+	}
+	pageNum, start, ok := rp.resumePage(vInfo)
+	if !ok {
+		return 0
+	}
+	log.Info().
+		Int("aid", vInfo.Aid).
+		Int("page", pageNum).
+		Int("start", start).
+		Msg("Resuming playback")
+
+	offset := 0
+	for i := range items {
+		if items[i].Page < pageNum {
+			offset += items[i].Duration
+			continue
+		}
+		if items[i].Page == pageNum && start > 0 {
+			items[i].Start = start
+			items[i].URL = appendQuery(items[i].URL, "t", strconv.Itoa(start))
+		}
+		break
+	}
+	return offset + start
+}
+
+// resumeStart 上次播放的位置在整个 MPD 中的时间(s), 没有记录时返回 0
+func resumeStart(vInfo *biligo.VideoInfo, account string, periods []PeriodData) int {
+	rp, err := fetchResumePoint(vInfo, account)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("aid", vInfo.Aid).
+			Msg("Failed to fetch resume point")
+		return 0
+	}
+	pageNum, start, ok := rp.resumePage(vInfo)
+	if !ok {
+		return 0
+	}
+	for _, period := range periods {
+		if period.Page != pageNum {
+			continue
+		}
+		log.Info().
+			Int("aid", vInfo.Aid).
+			Int("page", pageNum).
+			Int("start", start).
+			Msg("Resuming playback")
+		return period.Start + start
+	}
+	return 0
+}
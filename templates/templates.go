@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"html"
 	netUrl "net/url"
+	"strings"
 	"text/template"
+	"time"
 )
 
 //go:embed *.tmpl
@@ -13,14 +15,20 @@ var fs embed.FS
 
 type MpdData struct {
 	Title         string
+	CoverURL      string
 	OwnerName     string
 	Aid           int
 	Bvid          string
 	TotalDuration int
+	AudioOnly     bool
 	Periods       []PeriodData
 }
 
 type PeriodData struct {
+	Title           string
+	Page            int
+	Cid             int
+	Start           int // 在整个 MPD 中的起始时间(s)
 	Duration        int
 	VideoURL        string
 	VideoMimeType   string
@@ -37,6 +45,26 @@ type PeriodData struct {
 	AudioBandwidth  int
 	AudioInitRange  string
 	AudioIndexRange string
+	Chapters        []ChapterData
+	Thumbnails      *ThumbnailData
+	StartOffset     int    // 跳过该 Period 开头的时长(s), 作为 presentationTimeOffset
+	QualityLimited  string // 画质受限的原因, 只用于响应头
+}
+
+// ThumbnailData 雪碧图缩略图, 每张雪碧图为一个 segment
+type ThumbnailData struct {
+	Cols          int
+	Rows          int
+	TileWidth     int
+	TileHeight    int
+	SheetDuration int // 每张雪碧图覆盖的时长(ms)
+}
+
+// ChapterData 章节, 时间相对于所在分P的开头(s)
+type ChapterData struct {
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Title string `json:"title"`
 }
 
 const MPD_TEMPLATE = `MPD.tmpl`
@@ -46,6 +74,7 @@ var MpdTemplate = template.Must(
 		Funcs(template.FuncMap{
 			"mul":        func(a, b int) int { return a * b },
 			"add":        func(a, b int) int { return a + b },
+			"sub":        func(a, b int) int { return a - b },
 			"htmlEscape": html.EscapeString,
 			"urlEscape":  netUrl.QueryEscape,
 			"formatDuration": func(seconds int) string {
@@ -64,20 +93,159 @@ var MpdTemplate = template.Must(
 )
 
 type M3u8Data struct {
-	Title       string
-	MaxDuration int
-	Items       []M3u8Item
+	Title       string     `json:"title"`
+	Cover       string     `json:"cover,omitempty"`
+	MaxDuration int        `json:"-"`
+	Start       int        `json:"start,omitempty"` // EXT-X-START 开始播放的位置(s)
+	Items       []M3u8Item `json:"items"`
 }
 
 type M3u8Item struct {
-	Duration int
-	Title    string
-	URL      string
+	Duration    int    `json:"duration"`
+	Title       string `json:"title"`
+	Cover       string `json:"cover,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Group       string `json:"group,omitempty"` // 分组, 通常为所属视频/合集标题
+	Owner       string `json:"owner,omitempty"`
+	Bvid        string `json:"bvid,omitempty"`
+	Page        int    `json:"page,omitempty"`
+	Cid         int    `json:"cid,omitempty"`
+	PubDate     int    `json:"pubdate,omitempty"` // unix 时间戳(s)
+	Description string `json:"description,omitempty"`
+	Comment     string `json:"comment,omitempty"` // 非空时只输出注释行, 用于标记跳过的项
+	Start       int    `json:"start,omitempty"`   // 开始播放的位置(s)
+	// 章节, 以相对于 1970-01-01 的 EXT-X-PROGRAM-DATE-TIME 为零点输出 EXT-X-DATERANGE
+	Chapters []ChapterData `json:"chapters,omitempty"`
 }
 
 const M3U8_TEMPLATE = `M3U8.tmpl`
 
 var M3u8Template = template.Must(
 	template.New(M3U8_TEMPLATE).
+		Funcs(template.FuncMap{
+			"attrEscape": strings.NewReplacer(
+				"\r\n", " ", "\n", " ", "\r", " ", `"`, "'",
+			).Replace,
+			"lineEscape": strings.NewReplacer(
+				"\r\n", " ", "\n", " ", "\r", " ",
+			).Replace,
+			"formatDate": func(timestamp int) string {
+				return time.Unix(int64(timestamp), 0).Format(time.DateOnly)
+			},
+			"formatOffsetDate": func(seconds int) string {
+				return time.Unix(int64(seconds), 0).UTC().Format("2006-01-02T15:04:05.000Z")
+			},
+			"sub": func(a, b int) int { return a - b },
+		}).
 		ParseFS(fs, M3U8_TEMPLATE),
 )
+
+type VttData struct {
+	Cues []VttCue
+}
+
+// VttCue 时间单位为 ms
+type VttCue struct {
+	Start int
+	End   int
+	Text  string
+}
+
+const VTT_TEMPLATE = `VTT.tmpl`
+
+var VttTemplate = template.Must(
+	template.New(VTT_TEMPLATE).
+		Funcs(template.FuncMap{
+			"add": func(a, b int) int { return a + b },
+			"formatTimestamp": func(ms int) string {
+				return fmt.Sprintf("%02d:%02d:%02d.%03d",
+					ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+			},
+			// cue 正文中不能出现空行, "-->" 也会被误判为时间行
+			"cueEscape": strings.NewReplacer(
+				"&", "&amp;", "<", "&lt;", ">", "&gt;",
+				"\r\n", " ", "\n", " ", "\r", " ",
+			).Replace,
+		}).
+		ParseFS(fs, VTT_TEMPLATE),
+)
+
+type FFMetadata struct {
+	Title    string
+	Artist   string
+	Comment  string
+	Chapters []ChapterData
+}
+
+const FFMETADATA_TEMPLATE = `FFMETADATA.tmpl`
+
+var FFMetadataTemplate = template.Must(
+	template.New(FFMETADATA_TEMPLATE).
+		Funcs(template.FuncMap{
+			// https://ffmpeg.org/ffmpeg-formats.html#Metadata-2
+			"metaEscape": strings.NewReplacer(
+				`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", "\\\n",
+			).Replace,
+		}).
+		ParseFS(fs, FFMETADATA_TEMPLATE),
+)
+
+type FeedData struct {
+	Title       string
+	Link        string
+	Description string
+	Author      string
+	Image       string
+	Updated     int // unix 时间戳(s)
+	Items       []FeedItem
+}
+
+type FeedItem struct {
+	Title         string
+	Link          string
+	Guid          string
+	Description   string
+	PubDate       int // unix 时间戳(s)
+	Duration      int
+	Image         string
+	EnclosureURL  string
+	EnclosureType string
+}
+
+var feedFuncs = template.FuncMap{
+	"htmlEscape": html.EscapeString,
+	"formatRFC1123": func(timestamp int) string {
+		return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC1123Z)
+	},
+	"formatRFC3339": func(timestamp int) string {
+		return time.Unix(int64(timestamp), 0).UTC().Format(time.RFC3339)
+	},
+}
+
+const RSS_TEMPLATE = `RSS.tmpl`
+
+var RssTemplate = template.Must(
+	template.New(RSS_TEMPLATE).
+		Funcs(feedFuncs).
+		ParseFS(fs, RSS_TEMPLATE),
+)
+
+const ATOM_TEMPLATE = `ATOM.tmpl`
+
+var AtomTemplate = template.Must(
+	template.New(ATOM_TEMPLATE).
+		Funcs(feedFuncs).
+		ParseFS(fs, ATOM_TEMPLATE),
+)
+
+type LoginPageData struct {
+	Uid     int  // 已登录时非 0
+	Replace bool // 已登录时确认扫码切换账号
+}
+
+const LOGIN_TEMPLATE = `LOGIN.tmpl`
+
+var LoginTemplate = template.Must(
+	template.New(LOGIN_TEMPLATE).
+		ParseFS(fs, LOGIN_TEMPLATE),
+)
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Miuzarte/biligo"
 	"github.com/rs/zerolog/log"
@@ -79,3 +82,31 @@ func parseCodecPriority(priorityStr string) []int {
 
 	return codecs
 }
+
+// parseLength 解析 "mm:ss" / "hh:mm:ss" 格式的时长为秒数
+func parseLength(length string) int {
+	seconds := 0
+	for part := range strings.SplitSeq(length, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
+
+// parseSince 解析 unix 时间戳或 "2006-01-02" 格式的日期
+func parseSince(since string) (int, error) {
+	if since == "" {
+		return 0, nil
+	}
+	if timestamp, err := strconv.Atoi(since); err == nil {
+		return timestamp, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, since, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid since: %s", since)
+	}
+	return int(t.Unix()), nil
+}
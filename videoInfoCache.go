@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,41 +22,105 @@ type cacheEntry struct {
 	expiresAt time.Time
 }
 
+type cache map[string]*cacheEntry
+
 var (
-	videoInfoCache = make(map[string]*cacheEntry)
+	videoInfoCache = make(cache)
+	viewPointCache = make(cache)
+	videoshotCache = make(cache)
+	playlistCache  = make(cache) // 收藏夹, 合集等列表
+	streamCache    = make(cache) // 流地址 -> 所属视频, 用于推断播放进度
+	playurlCache   = make(cache) // cid -> 播放地址, 避免多 P 的 MPD 被反复嗅探时重复请求
 	cacheMutex     sync.RWMutex
+
+	// 需要定期清理的缓存
+	caches = []cache{
+		videoInfoCache,
+		viewPointCache,
+		videoshotCache,
+		playlistCache,
+		streamCache,
+		playurlCache,
+	}
 )
 
-func getCachedVideoInfo(id string) (*biligo.VideoInfo, bool) {
+func getCached[T any](c cache, key string) (T, bool) {
 	cacheMutex.RLock()
 	defer cacheMutex.RUnlock()
 
-	if entry, ok := videoInfoCache[id]; ok {
+	if entry, ok := c[key]; ok {
 		if time.Now().Before(entry.expiresAt) {
-			return entry.data.(*biligo.VideoInfo), true
+			return entry.data.(T), true
 		}
 	}
-	return nil, false
+	var zero T
+	return zero, false
 }
 
-func setCachedVideoInfo(id string, info *biligo.VideoInfo) {
+func setCached(c cache, key string, data any, ttl time.Duration) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	videoInfoCache[id] = &cacheEntry{
-		data:      info,
-		expiresAt: time.Now().Add(5 * time.Minute), // Cache for 5 minutes
+	c[key] = &cacheEntry{
+		data:      data,
+		expiresAt: time.Now().Add(ttl),
 	}
 }
 
+func getCachedVideoInfo(id string) (*biligo.VideoInfo, bool) {
+	return getCached[*biligo.VideoInfo](videoInfoCache, id)
+}
+
+func setCachedVideoInfo(id string, info *biligo.VideoInfo) {
+	setCached(videoInfoCache, id, info, 5*time.Minute) // Cache for 5 minutes
+}
+
 func cleanupExpiredCache() {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
 	now := time.Now()
-	for id, entry := range videoInfoCache {
-		if now.After(entry.expiresAt) {
-			delete(videoInfoCache, id)
+	for _, c := range caches {
+		for key, entry := range c {
+			if now.After(entry.expiresAt) {
+				delete(c, key)
+			}
+		}
+	}
+}
+
+// clearCaches 清空所有缓存, 用于退出登录后丢弃登录状态下获取的数据
+func clearCaches() {
+	cacheMutex.Lock()
+	for _, c := range caches {
+		clear(c)
+	}
+	cacheMutex.Unlock()
+	cleanupAudioCache(0)
+}
+
+// clearAccountCaches 清除具名账号登录状态下获取的播放地址, 上次播放位置与音频缓存
+func clearAccountCaches(account string) {
+	suffix := accountSuffix(account)
+	cacheMutex.Lock()
+	for _, c := range caches {
+		for key := range c {
+			if strings.HasSuffix(key, suffix) {
+				delete(c, key)
+			}
+		}
+	}
+	cacheMutex.Unlock()
+
+	entries, err := os.ReadDir(audioCacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		// aid_cid@account[_t123].m4a
+		_, name, ok := strings.Cut(entry.Name(), suffix)
+		if ok && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_t")) {
+			os.Remove(filepath.Join(audioCacheDir, entry.Name()))
 		}
 	}
 }
@@ -61,13 +128,20 @@ func cleanupExpiredCache() {
 func startCacheCleanup(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
+	// 图片缓存文件较多, 不必频繁扫描
+	diskTicker := time.NewTicker(1 * time.Hour)
+	defer diskTicker.Stop()
+	cleanupImageCache()
 
 	for {
 		select {
 		case <-ticker.C:
 			cleanupExpiredCache()
+			cleanupAudioCache(AUDIO_CACHE_TTL)
 			log.Trace().
 				Msg("Cache cleanup completed")
+		case <-diskTicker.C:
+			cleanupImageCache()
 		case <-ctx.Done():
 			return
 		}